@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+	"github.com/cheetahfox/openstack-instance-stats/filter"
+	"github.com/cheetahfox/openstack-instance-stats/keystone"
+	"github.com/cheetahfox/openstack-instance-stats/metrics"
+	"github.com/cheetahfox/openstack-instance-stats/prometheus"
+	"github.com/cheetahfox/openstack-instance-stats/sink"
+	"github.com/cheetahfox/openstack-instance-stats/tagging"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+)
+
+/*
+collector is one cloud and region we collect from. Each collector has its own
+credentials, scope and counter state, so a target that's down or failing
+doesn't hold up any of the others. It lives as long as the process and holds
+on to the service clients between passes.
+*/
+type collector struct {
+	name     string // the cloud tag
+	conf     config.OpenStack
+	provider *gophercloud.ProviderClient
+	rates    *metrics.Rates
+	projects *keystone.Projects
+	filter   *filter.Filter
+	tagger   *tagging.Tagger
+	last     map[string]metrics.Vms // instances of the last pass by uuid, for the status events
+
+	// The server list kept up to date with changes-since, only used by inventoryWorker
+	inventory map[string]metrics.Vms
+	synced    time.Time // last listing, full or not
+	resynced  time.Time // last full listing
+	ports     map[string]serverPorts
+
+	// What inventoryWorker hands statsWorker
+	listMu  sync.Mutex
+	listed  []metrics.Vms
+	portIdx portIndex
+	ok      bool  // listed at least once
+	listErr error // why the last listing failed, nil when it worked
+
+	mu  sync.Mutex
+	svc *services
+}
+
+/*
+services are the clients for every OpenStack service we talk to. They only
+get built again when the token changes, a reauth (AllowReauth) can come back
+with a different catalog and the endpoints in the clients would be stale.
+*/
+type services struct {
+	token    string // token the clients were built with
+	compute  *gophercloud.ServiceClient
+	network  *gophercloud.ServiceClient // nil without Neutron in the catalog
+	identity *gophercloud.ServiceClient // nil without Keystone in the catalog
+}
+
+func (c *collector) String() string {
+	if c.conf.Region == "" {
+		return c.name
+	}
+	return c.name + "/" + c.conf.Region
+}
+
+/*
+Get the service clients, building them the first time or after a reauth. The
+clients handed out are on a provider of their own whose requests are cut off
+after timeout, each worker passes its own interval so a slow listing isn't held
+to the diagnostics interval. Requests still going when ctx is done are
+cancelled, that's how a pass is cut off at its deadline.
+*/
+func (c *collector) services(ctx context.Context, timeout time.Duration) (*services, error) {
+	svc, err := c.sharedServices()
+	if err != nil {
+		return nil, err
+	}
+	return svc.on(c.workerProvider(ctx, timeout)), nil
+}
+
+func (c *collector) sharedServices() (*services, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	token := c.provider.Token()
+	if c.svc != nil && c.svc.token == token {
+		return c.svc, nil
+	}
+
+	endpoint := c.conf.EndpointOpts()
+	compute, err := openstack.NewComputeV2(c.provider, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// 2.47 and newer embed the flavor details in the server, 2.48 standardizes the diagnostics
+	compute.Microversion, err = novaMicroversion(compute)
+	if err != nil {
+		return nil, err
+	}
+
+	// We can still collect without these, we just can't tag as much
+	network, err := openstack.NewNetworkV2(c.provider, endpoint)
+	if err != nil {
+		log.Println(err)
+		log.Printf("No Neutron endpoint for %s, network stats won't have port tags\n", c)
+		network = nil
+	}
+	identity, err := openstack.NewIdentityV3(c.provider, endpoint)
+	if err != nil {
+		log.Println(err)
+		log.Printf("No Keystone endpoint for %s, project names won't be looked up\n", c)
+		identity = nil
+	}
+
+	c.svc = &services{
+		token:    token,
+		compute:  compute,
+		network:  network,
+		identity: identity,
+	}
+	return c.svc, nil
+}
+
+// The instances and Neutron ports from the last listing, ok is false until there is one
+func (c *collector) instances() ([]metrics.Vms, portIndex, bool) {
+	c.listMu.Lock()
+	defer c.listMu.Unlock()
+	return c.listed, c.portIdx, c.ok
+}
+
+func (c *collector) setInstances(instances []metrics.Vms, portIdx portIndex) {
+	c.listMu.Lock()
+	defer c.listMu.Unlock()
+	c.listed = instances
+	c.portIdx = portIdx
+	c.ok = true
+	c.listErr = nil
+}
+
+// The last listing failed, the instances of the one before are kept
+func (c *collector) listFailed(err error) {
+	c.listMu.Lock()
+	defer c.listMu.Unlock()
+	c.listErr = err
+}
+
+// Health fails until the first listing and while the last one is failing
+func (c *collector) Health(_ context.Context) error {
+	c.listMu.Lock()
+	defer c.listMu.Unlock()
+	if c.listErr != nil {
+		return fmt.Errorf("%s: %w", c, c.listErr)
+	}
+	if !c.ok {
+		return fmt.Errorf("%s: no server list yet", c)
+	}
+	return nil
+}
+
+// collection is every target, it's healthy while they all are
+type collection struct {
+	mu         sync.Mutex
+	collectors []*collector
+}
+
+func (all *collection) add(c *collector) {
+	all.mu.Lock()
+	defer all.mu.Unlock()
+	all.collectors = append(all.collectors, c)
+}
+
+func (all *collection) Health(ctx context.Context) error {
+	all.mu.Lock()
+	defer all.mu.Unlock()
+	for _, c := range all.collectors {
+		if err := c.Health(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+A provider for one worker with its own http client timeout. It starts out with
+the token of the shared provider and reauthenticates through it, so only one of
+the workers ends up asking Keystone for a new token and the rest pick it up.
+*/
+func (c *collector) workerProvider(ctx context.Context, timeout time.Duration) *gophercloud.ProviderClient {
+	shared := c.provider
+	p := &gophercloud.ProviderClient{
+		IdentityBase:     shared.IdentityBase,
+		IdentityEndpoint: shared.IdentityEndpoint,
+		EndpointLocator:  shared.EndpointLocator,
+		HTTPClient:       shared.HTTPClient,
+		UserAgent:        shared.UserAgent,
+		Context:          ctx,
+	}
+	p.HTTPClient.Timeout = timeout
+	p.UseTokenLock()
+	p.CopyTokenFrom(shared)
+	p.ReauthFunc = func() error {
+		// Skipped when another worker already got a new token
+		if err := shared.Reauthenticate(p.Token()); err != nil {
+			return err
+		}
+		p.CopyTokenFrom(shared)
+		return nil
+	}
+	return p
+}
+
+// A copy of the clients that make their requests with provider
+func (s *services) on(provider *gophercloud.ProviderClient) *services {
+	bound := func(client *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+		if client == nil {
+			return nil
+		}
+		copied := *client
+		copied.ProviderClient = provider
+		return &copied
+	}
+	return &services{
+		token:    s.token,
+		compute:  bound(s.compute),
+		network:  bound(s.network),
+		identity: bound(s.identity),
+	}
+}
+
+/*
+runTarget authenticates with the target, retrying every refresh interval until
+it works, then runs its collectors until ctx is done. The target counts
+towards the health of all from the start.
+*/
+func runTarget(ctx context.Context, conf config.Sysconfig, o config.OpenStack, f *filter.Filter, tagger *tagging.Tagger, out sink.Sink, prom *prometheus.Prometheus, all *collection) {
+	c := &collector{
+		name:     o.CloudName(),
+		conf:     o,
+		rates:    metrics.NewRates(),
+		projects: keystone.NewProjects(conf.Collection.ProjectCacheTTL.Duration),
+		filter:   f,
+		tagger:   tagger,
+	}
+	all.add(c)
+
+	for {
+		provider, err := config.Authenticate(o)
+		if err == nil {
+			c.provider = provider
+			break
+		}
+		log.Println(err)
+		log.Printf("Error while authenticating with %s, trying again in %s\n", c, conf.Collection.RefreshInterval.Duration)
+		select {
+		case <-time.After(conf.Collection.RefreshInterval.Duration):
+		case <-ctx.Done():
+			return
+		}
+	}
+	// Reauthenticating and building the clients goes through the shared provider, nothing should take longer than the longest interval
+	c.provider.HTTPClient.Timeout = conf.Collection.RefreshInterval.Duration
+	for _, interval := range []time.Duration{conf.Collection.InventoryInterval.Duration, conf.Collection.HypervisorInterval.Duration} {
+		if interval > c.provider.HTTPClient.Timeout {
+			c.provider.HTTPClient.Timeout = interval
+		}
+	}
+	log.Printf("Authenticated with %s\n", c)
+
+	var workers sync.WaitGroup
+	if o.Scope == "site" {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			hypervisorWorker(ctx, conf, c, out)
+		}()
+	}
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		inventoryWorker(ctx, conf, c, out)
+	}()
+	statsWorker(ctx, conf, c, out, prom)
+	workers.Wait()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+	"github.com/gophercloud/gophercloud/openstack"
+)
+
+/*
+A cloud with just enough of Keystone to get a token and a catalog, and the Nova
+version document novaMicroversion asks for. Only the last token handed out is
+accepted.
+*/
+type fakeCloud struct {
+	conf     config.OpenStack
+	mux      *http.ServeMux // for the tests to add to
+	versions int64          // Nova version documents served
+	issued   int64          // tokens handed out
+}
+
+func newFakeCloud(tb testing.TB) *fakeCloud {
+	mux := http.NewServeMux()
+	f := &fakeCloud{mux: mux}
+	srv := httptest.NewServer(mux)
+	tb.Cleanup(srv.Close)
+
+	endpoint := func(path string) string {
+		return fmt.Sprintf(`{"id": "%s", "interface": "public", "region": "RegionOne", "region_id": "RegionOne", "url": "%s%s"}`, path, srv.URL, path)
+	}
+	token := fmt.Sprintf(`{"token": {
+		"expires_at": "2099-01-01T00:00:00.000000Z",
+		"project": {"id": "p1", "name": "web", "domain": {"id": "default", "name": "Default"}},
+		"catalog": [
+			{"type": "compute", "name": "nova", "id": "c", "endpoints": [%s]},
+			{"type": "network", "name": "neutron", "id": "n", "endpoints": [%s]},
+			{"type": "identity", "name": "keystone", "id": "i", "endpoints": [%s]}
+		]
+	}}`, endpoint("/compute/v2.1"), endpoint("/network/"), endpoint("/identity/v3/"))
+
+	mux.HandleFunc("POST /identity/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Subject-Token", fmt.Sprintf("token-%d", atomic.AddInt64(&f.issued, 1)))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, token)
+	})
+	mux.HandleFunc("GET /compute/v2.1/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-Token") != f.token() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt64(&f.versions, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"version": {"id": "v2.1", "status": "CURRENT", "version": "2.79", "min_version": "2.1"}}`)
+	})
+
+	f.conf = config.OpenStack{
+		AuthURL:        srv.URL + "/identity/v3/",
+		Username:       "stats",
+		Password:       "secret",
+		UserDomainName: "Default",
+		ProjectID:      "p1",
+		Region:         "RegionOne",
+		Interface:      "public",
+	}
+	return f
+}
+
+// The one token that's accepted
+func (f *fakeCloud) token() string {
+	return fmt.Sprintf("token-%d", atomic.LoadInt64(&f.issued))
+}
+
+func fakeCollector(tb testing.TB) (*collector, *fakeCloud) {
+	f := newFakeCloud(tb)
+	provider, err := config.Authenticate(f.conf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &collector{name: f.conf.CloudName(), conf: f.conf, provider: provider}, f
+}
+
+func TestServicesReused(t *testing.T) {
+	c, f := fakeCollector(t)
+
+	first, err := c.services(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.compute.Microversion != standardDiagnostics {
+		t.Errorf("microversion %q, want %q", first.compute.Microversion, standardDiagnostics)
+	}
+	if first.network == nil || first.identity == nil {
+		t.Error("the network and identity clients weren't built from the catalog")
+	}
+	second, err := c.services(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&f.versions) != 1 {
+		t.Errorf("the Nova version was asked %d times, want once", atomic.LoadInt64(&f.versions))
+	}
+	if second.compute.Endpoint != first.compute.Endpoint {
+		t.Errorf("compute endpoint %s the second time, want %s", second.compute.Endpoint, first.compute.Endpoint)
+	}
+	for _, svc := range []*services{first, second} {
+		if svc.compute.ProviderClient == c.provider || svc.network.ProviderClient != svc.compute.ProviderClient || svc.identity.ProviderClient != svc.compute.ProviderClient {
+			t.Error("the clients aren't on a provider of their own")
+		}
+	}
+	if first.compute.HTTPClient.Timeout != time.Minute || second.compute.HTTPClient.Timeout != time.Hour {
+		t.Errorf("timeouts %s and %s, want 1m and 1h", first.compute.HTTPClient.Timeout, second.compute.HTTPClient.Timeout)
+	}
+	if c.provider.HTTPClient.Timeout != 0 {
+		t.Errorf("the shared provider's timeout was changed to %s", c.provider.HTTPClient.Timeout)
+	}
+
+	// A reauth can come back with a different catalog
+	c.provider.SetToken("another")
+	if _, err := c.services(context.Background(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&f.versions) != 2 {
+		t.Errorf("the clients weren't built again after the token changed")
+	}
+}
+
+// Workers reauthenticate through the shared provider, only one of them gets a new token
+func TestServicesReauth(t *testing.T) {
+	c, f := fakeCollector(t)
+	first, err := c.services(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.services(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else logging in revokes our token
+	if _, err := config.Authenticate(f.conf); err != nil {
+		t.Fatal(err)
+	}
+	for i, svc := range []*services{first, second} {
+		if _, err := novaMicroversion(svc.compute); err != nil {
+			t.Fatalf("worker %d: %s", i, err)
+		}
+		if svc.compute.Token() != f.token() {
+			t.Errorf("worker %d has token %s, want %s", i, svc.compute.Token(), f.token())
+		}
+	}
+	if c.provider.Token() != f.token() {
+		t.Errorf("shared provider has token %s, want %s", c.provider.Token(), f.token())
+	}
+	if got := atomic.LoadInt64(&f.issued); got != 3 {
+		t.Errorf("%d tokens issued, want 3", got)
+	}
+}
+
+// How every diagnostics call got its compute client before the collector kept them
+func BenchmarkPerInstanceClient(b *testing.B) {
+	c, f := fakeCollector(b)
+	endpoint := c.conf.EndpointOpts()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		client, err := openstack.NewComputeV2(c.provider, endpoint)
+		if err != nil {
+			b.Fatal(err)
+		}
+		client.Microversion, err = novaMicroversion(client)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&f.versions))/float64(b.N), "requests/op")
+}
+
+func BenchmarkCollectorServices(b *testing.B) {
+	c, f := fakeCollector(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := c.services(context.Background(), time.Minute); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&f.versions))/float64(b.N), "requests/op")
+}
+
+// Ready once every target has listed its servers, not while a listing is failing
+func TestCollectionHealth(t *testing.T) {
+	first := &collector{name: "first"}
+	second := &collector{name: "second", conf: config.OpenStack{Region: "RegionTwo"}}
+	all := &collection{}
+	all.add(first)
+	all.add(second)
+
+	tests := []struct {
+		name   string
+		update func()
+		err    string
+	}{
+		{"nothing listed", func() {}, "first: no server list yet"},
+		{"one listed", func() { first.setInstances(nil, portIndex{}) }, "second/RegionTwo: no server list yet"},
+		{"both listed", func() { second.setInstances(nil, portIndex{}) }, ""},
+		{"listing failed", func() { second.listFailed(errors.New("nova is down")) }, "second/RegionTwo: nova is down"},
+		{"listed again", func() { second.setInstances(nil, portIndex{}) }, ""},
+	}
+	for _, tt := range tests {
+		tt.update()
+		err := all.Health(context.Background())
+		if got := fmt.Sprint(err); (err != nil || tt.err != "") && got != tt.err {
+			t.Errorf("%s: health %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
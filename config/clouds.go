@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// The subset of clouds.yaml we understand
+type cloudsFile struct {
+	Clouds map[string]cloud `yaml:"clouds"`
+}
+
+type cloud struct {
+	Auth struct {
+		AuthURL                     string `yaml:"auth_url"`
+		Username                    string `yaml:"username"`
+		Password                    string `yaml:"password"`
+		Token                       string `yaml:"token"`
+		UserDomainName              string `yaml:"user_domain_name"`
+		UserDomainID                string `yaml:"user_domain_id"`
+		DomainName                  string `yaml:"domain_name"`
+		DomainID                    string `yaml:"domain_id"`
+		ProjectID                   string `yaml:"project_id"`
+		ProjectName                 string `yaml:"project_name"`
+		ProjectDomainName           string `yaml:"project_domain_name"`
+		ProjectDomainID             string `yaml:"project_domain_id"`
+		ApplicationCredentialID     string `yaml:"application_credential_id"`
+		ApplicationCredentialName   string `yaml:"application_credential_name"`
+		ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+	} `yaml:"auth"`
+	RegionName string `yaml:"region_name"`
+	Interface  string `yaml:"interface"`
+	CACert     string `yaml:"cacert"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	Verify     *bool  `yaml:"verify"`
+	// Not part of the standard clouds.yaml, other tools just ignore it
+	Scope string `yaml:"scope"`
+}
+
+// Where the OpenStack clients look for clouds.yaml, in order
+func cloudsPaths() []string {
+	paths := []string{"clouds.yaml"}
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "openstack", "clouds.yaml"))
+	}
+	return append(paths, "/etc/openstack/clouds.yaml")
+}
+
+/*
+Fill in the OpenStack settings from the named cloud in clouds.yaml. path is
+the clouds.yaml to use, when it's empty the standard locations are searched.
+Whatever the cloud entry sets wins over the config file.
+*/
+func loadCloud(o *OpenStack) error {
+	path := o.CloudsFile
+	if path == "" {
+		for _, p := range cloudsPaths() {
+			if _, err := os.Stat(p); err == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return errors.New("openstack.cloud is set but no clouds.yaml was found")
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "reading clouds.yaml")
+	}
+	var clouds cloudsFile
+	err = yaml.Unmarshal(data, &clouds)
+	if err != nil {
+		return errors.Wrapf(err, "parsing %s", path)
+	}
+	c, ok := clouds.Clouds[o.Cloud]
+	if !ok {
+		return fmt.Errorf("openstack.cloud %q isn't in %s", o.Cloud, path)
+	}
+
+	set := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	set(&o.AuthURL, c.Auth.AuthURL)
+	set(&o.Username, c.Auth.Username)
+	set(&o.Password, c.Auth.Password)
+	set(&o.Token, c.Auth.Token)
+	// domain_name is the older way of setting the user's domain
+	set(&o.UserDomainName, c.Auth.DomainName)
+	set(&o.UserDomainName, c.Auth.UserDomainName)
+	set(&o.UserDomainID, c.Auth.DomainID)
+	set(&o.UserDomainID, c.Auth.UserDomainID)
+	set(&o.ProjectID, c.Auth.ProjectID)
+	set(&o.ProjectName, c.Auth.ProjectName)
+	set(&o.ProjectDomainName, c.Auth.ProjectDomainName)
+	set(&o.ProjectDomainID, c.Auth.ProjectDomainID)
+	set(&o.ApplicationCredentialID, c.Auth.ApplicationCredentialID)
+	set(&o.ApplicationCredentialName, c.Auth.ApplicationCredentialName)
+	set(&o.ApplicationCredentialSecret, c.Auth.ApplicationCredentialSecret)
+	set(&o.Region, c.RegionName)
+	set(&o.Interface, c.Interface)
+	set(&o.CACert, c.CACert)
+	set(&o.Cert, c.Cert)
+	set(&o.Key, c.Key)
+	set(&o.Scope, c.Scope)
+	if c.Verify != nil {
+		o.Insecure = !*c.Verify
+	}
+	return nil
+}
@@ -1,105 +1,746 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
-	"github.com/pkg/errors"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
 )
 
+// Disk device prefixes are just letters, they get built into a regexp
+var diskPrefix = regexp.MustCompile("^[a-z]+$")
+
+/*
+Duration is a time.Duration in the config file, written like 30s or 5m. A plain
+number is seconds like in the environment, yaml would otherwise take it as
+nanoseconds.
+*/
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	parsed, err := parseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration like 30s or a number of seconds", v)
+	}
+	d.Duration = parsed
+	return nil
+}
 
+/*
+Sysconfig is the whole program configuration. It's read from the YAML file
+given with --config and then any of the environment variables in env.go that
+are set override what's in the file, so an env only setup still works.
+After Load, Targets holds every cloud and region to collect from.
+*/
 type Sysconfig struct {
-	Bucket         string
-	InfluxdbServer string
-	Org            string
-	Token          string
-	RefreshTime    int
-	WebPort        string
-	Scope          string
-}
-
-
-// This fucntion sets up the program func startup() *gophercloud.ProviderClient
-func Startup() (*gophercloud.ProviderClient, Sysconfig) {
-	var config Sysconfig
-
-	// Required Enviorment vars mostly OpenStack Env vars.
-	requiredEnvVars := []string{
-		"OS_AUTH_URL",
-		"OS_USERNAME",
-		"OS_PASSWORD",
-		"OS_PROJECT_DOMAIN_ID",
-		"OS_REGION_NAME",
-		"OS_PROJECT_NAME",
-		"OS_USER_DOMAIN_NAME",
-		"OS_INTERFACE",
-		"OS_PROJECT_ID",
-		"OS_DOMAIN_NAME",
-		"OS_REGION_NAME",
-		"INFLUX_SERVER", // Influxdb server url including port number
-		"INFLUX_TOKEN",  // Influx Token
-		"INFLUX_BUCKET", // Influx bucket
-		"INFLUX_ORG",    // Influx ord
-		"STATS_PORT",    // port number for the kubernetes checks
-		"SCOPE",         // "site" or "project"; get stats on ALL instances or just a single project
-	}
-
-	// Newer Openstack Env might not have this set, so if we have USER domain we match it
-	if os.Getenv("OS_DOMAIN_NAME") == "" || os.Getenv("OS_USER_DOMAIN_NAME") != "" {
-		os.Setenv("OS_DOMAIN_NAME", os.Getenv("OS_USER_DOMAIN_NAME"))
-	}
-
-	// Check if the Required Enviromental varibles are set exit if they aren't.
-	for index := range requiredEnvVars {
-		if os.Getenv(requiredEnvVars[index]) == "" {
-			log.Fatalf("Missing %s Enviroment var \n", requiredEnvVars[index])
-		}
-	}
-
-	// Set the config from the Env
-	config.WebPort = os.Getenv("STATS_PORT")
-	config.InfluxdbServer = os.Getenv("INFLUX_SERVER")
-	config.Token = os.Getenv("INFLUX_TOKEN")
-	config.Bucket = os.Getenv("INFLUX_BUCKET")
-	config.Org = os.Getenv("INFLUX_ORG")
-	config.Scope = os.Getenv("SCOPE")
-
-	provider, err := osAuth()
+	OpenStack  OpenStack   `yaml:"openstack"`
+	Targets    []OpenStack `yaml:"targets"` // clouds and regions to collect from, just openstack if empty
+	Collection Collection  `yaml:"collection"`
+	Filters    Filters     `yaml:"filters"`
+	Tags       Tags        `yaml:"instance_tags"`
+	Outputs    Outputs     `yaml:"outputs"`
+	WebPort    string      `yaml:"web_port"` // port number for the kubernetes checks and /metrics
+
+	singleTarget bool // Targets is just the openstack section, so that's what problems are reported against
+}
+
+/*
+OpenStack credentials and what we collect from. Setting Cloud loads the
+settings from that entry in clouds.yaml instead. We authenticate with an
+application credential if there is one, then a token, then username/password.
+*/
+type OpenStack struct {
+	Name                        string `yaml:"name"`        // cloud tag, defaults to the clouds.yaml name or the auth_url host
+	Cloud                       string `yaml:"cloud"`       // name of the cloud in clouds.yaml
+	CloudsFile                  string `yaml:"clouds_file"` // clouds.yaml path, the standard locations are searched if empty
+	AuthURL                     string `yaml:"auth_url"`
+	Username                    string `yaml:"username"`
+	Password                    string `yaml:"password"`
+	Token                       string `yaml:"token"`
+	ApplicationCredentialID     string `yaml:"application_credential_id"`
+	ApplicationCredentialName   string `yaml:"application_credential_name"` // needs username and user domain
+	ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+	UserDomainName              string `yaml:"user_domain_name"`
+	UserDomainID                string `yaml:"user_domain_id"`
+	ProjectID                   string `yaml:"project_id"`
+	ProjectName                 string `yaml:"project_name"`
+	ProjectDomainName           string `yaml:"project_domain_name"`
+	ProjectDomainID             string `yaml:"project_domain_id"`
+	Region                      string `yaml:"region_name"`
+	Interface                   string `yaml:"interface"` // public, internal or admin endpoints
+	Scope                       string `yaml:"scope"`     // "site" or "project"; get stats on ALL instances or just a single project
+	CACert                      string `yaml:"cacert"`    // CA bundle to verify the OpenStack endpoints with
+	Cert                        string `yaml:"cert"`      // client certificate and key
+	Key                         string `yaml:"key"`
+	Insecure                    bool   `yaml:"insecure"` // don't verify certificates at all
+}
+
+// CloudName is what we tag this cloud's points with
+func (o OpenStack) CloudName() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	if o.Cloud != "" {
+		return o.Cloud
+	}
+	if u, err := url.Parse(o.AuthURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return o.AuthURL
+}
+
+// Application credentials are already scoped to a project
+func (o OpenStack) appCredential() bool {
+	return o.ApplicationCredentialID != "" || o.ApplicationCredentialName != ""
+}
+
+/*
+Collection tuning. The diagnostics are collected every refresh_interval, the
+server list and the hypervisors on their own intervals which default to it.
+*/
+type Collection struct {
+	RefreshInterval    Duration `yaml:"refresh_interval"`     // diagnostics
+	InventoryInterval  Duration `yaml:"inventory_interval"`   // listing the servers and the inventory
+	HypervisorInterval Duration `yaml:"hypervisor_interval"`  // os-hypervisors, site scope only
+	Jitter             Duration `yaml:"jitter"`               // passes start a random delay up to this late
+	Align              bool     `yaml:"align"`                // passes are due on multiples of their interval and points are stamped with it
+	Workers            int      `yaml:"workers"`              // concurrent diagnostics requests
+	RateLimit          float64  `yaml:"rate_limit"`           // max diagnostics requests per second, 0 is unlimited
+	DiskDevices        []string `yaml:"disk_devices"`         // disk device name prefixes, vd for vda, vdb...
+	ProjectCacheTTL    Duration `yaml:"project_cache_ttl"`    // how long to cache project and domain names
+	FullResync         Duration `yaml:"full_resync_interval"` // list every server this often, only the changes in between. 0 lists everything every pass
+	PrimaryNetwork     string   `yaml:"primary_network"`      // regular expression on the network names to take the IP tag from, any if empty
+	PrimaryAddress     string   `yaml:"primary_address"`      // fixed or floating, which address the IP tag prefers
+}
+
+/*
+Filters pick the instances we collect from. An instance is collected when it
+matches every include rule that's set and none of the exclude rules.
+*/
+type Filters struct {
+	Include Filter `yaml:"include"`
+	Exclude Filter `yaml:"exclude"`
+}
+
+type Filter struct {
+	Projects          []string          `yaml:"projects"`           // project ids or names
+	Name              string            `yaml:"name"`               // regular expression on the instance name
+	Metadata          map[string]string `yaml:"metadata"`           // key and value, an empty value matches any value
+	Tags              []string          `yaml:"tags"`               // Nova server tags
+	AvailabilityZones []string          `yaml:"availability_zones"` // availability zone names
+}
+
+/*
+Tags are the server metadata keys and Nova server tags that are copied onto
+every point of an instance. Metadata keys become tags with the metadata value,
+server tags become tags with the value "true" when the server has them.
+*/
+type Tags struct {
+	Metadata   []string `yaml:"metadata"`    // metadata keys
+	ServerTags []string `yaml:"server_tags"` // Nova server tags
+	MaxValues  int      `yaml:"max_values"`  // distinct values kept per tag, the rest are written as _other
+}
+
+type Outputs struct {
+	QueueSize   int         `yaml:"queue_size"` // batches each output can fall behind before they're dropped
+	Critical    []string    `yaml:"critical"`   // outputs /readyz also depends on: influxdb, influxdb-udp or otlp
+	Naming      Naming      `yaml:"naming"`
+	InfluxDB    InfluxDB    `yaml:"influxdb"`
+	InfluxDBUDP InfluxDBUDP `yaml:"influxdb_udp"`
+	OTLP        OTLP        `yaml:"otlp"`
+	Prometheus  Prometheus  `yaml:"prometheus"`
+}
+
+type InfluxDB struct {
+	Server  string `yaml:"server"`  // Influxdb server url including port number, empty to disable
+	Version int    `yaml:"version"` // 2, or 1 for the 1.x /write api
+	// InfluxDB 2
+	Token  string `yaml:"token"`
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	// InfluxDB 1.x
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"` // empty for the database default
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	Consistency     string `yaml:"consistency"` // any, one, quorum or all, only used by clusters
+
+	Precision     string   `yaml:"precision"`      // ns, us, ms or s
+	BatchSize     int      `yaml:"batch_size"`     // points per write
+	FlushInterval Duration `yaml:"flush_interval"` // longest a point waits for its batch to fill
+	Spool         Spool    `yaml:"spool"`
+}
+
+// Spool keeps batches that failed to write on disk until InfluxDB is back
+type Spool struct {
+	Dir            string   `yaml:"dir"`             // empty disables spooling, failed batches are dropped
+	MaxSizeMB      int      `yaml:"max_size_mb"`     // oldest batches are dropped past this
+	ReplayInterval Duration `yaml:"replay_interval"` // how often to check whether InfluxDB is back
+}
+
+/*
+Naming picks the measurement, tag and field names the InfluxDB and OTLP outputs
+write. The overrides are keyed by the legacy name and go on top of the profile.
+*/
+type Naming struct {
+	Profile      string            `yaml:"profile"` // legacy or v2
+	Measurements map[string]string `yaml:"measurements"`
+	Tags         map[string]string `yaml:"tags"`
+	Fields       map[string]string `yaml:"fields"`
+}
+
+// InfluxDBUDP sends line protocol to an InfluxDB 1.x UDP listener, nothing is retried
+type InfluxDBUDP struct {
+	Address     string `yaml:"address"`      // host:port, empty to disable
+	PayloadSize int    `yaml:"payload_size"` // largest datagram to send
+	Precision   string `yaml:"precision"`    // ns, us, ms or s, has to match the listener
+}
+
+// OTLP exports the metrics to an OpenTelemetry collector
+type OTLP struct {
+	Endpoint      string            `yaml:"endpoint"` // http:// or https:// url of the collector, empty to disable
+	Protocol      string            `yaml:"protocol"` // http/protobuf or grpc
+	Headers       map[string]string `yaml:"headers"`  // sent with every export, for auth
+	CACert        string            `yaml:"cacert"`
+	Insecure      bool              `yaml:"insecure"` // don't verify the collector's certificate
+	Timeout       Duration          `yaml:"timeout"`
+	BatchSize     int               `yaml:"batch_size"`     // samples per export
+	FlushInterval Duration          `yaml:"flush_interval"` // longest a sample waits for its batch to fill
+}
+
+type Prometheus struct {
+	Enabled bool `yaml:"enabled"` // serve /metrics
+}
+
+func openstackDefaults() OpenStack {
+	return OpenStack{
+		Interface: "public",
+		Scope:     "project",
+	}
+}
+
+// Everything that isn't required has a default
+func defaults() Sysconfig {
+	return Sysconfig{
+		OpenStack: openstackDefaults(),
+		Collection: Collection{
+			RefreshInterval: Duration{15 * time.Second},
+			Workers:         4,
+			// virtio-blk, ide, scsi and xen disks
+			DiskDevices:     []string{"vd", "hd", "sd", "xvd"},
+			ProjectCacheTTL: Duration{10 * time.Minute},
+			FullResync:      Duration{10 * time.Minute},
+			PrimaryAddress:  "fixed",
+		},
+		Tags: Tags{MaxValues: 100},
+		Outputs: Outputs{
+			QueueSize: 1000,
+			Naming:    Naming{Profile: "legacy"},
+			InfluxDB: InfluxDB{
+				Version:       2,
+				Precision:     "ns",
+				BatchSize:     5000,
+				FlushInterval: Duration{time.Second},
+				Spool: Spool{
+					MaxSizeMB:      100,
+					ReplayInterval: Duration{10 * time.Second},
+				},
+			},
+			InfluxDBUDP: InfluxDBUDP{
+				PayloadSize: 512,
+				Precision:   "ns",
+			},
+			OTLP: OTLP{
+				Protocol:      "http/protobuf",
+				Timeout:       Duration{10 * time.Second},
+				BatchSize:     1000,
+				FlushInterval: Duration{time.Second},
+			},
+			Prometheus: Prometheus{Enabled: true},
+		},
+		WebPort: "3210",
+	}
+}
+
+// Load reads and validates the configuration without talking to anything.
+func Load(path string) (Sysconfig, error) {
+	config := defaults()
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config, errors.Wrap(err, "reading config file")
+		}
+		// Strict so a misspelled key is an error rather than silently ignored
+		err = yaml.UnmarshalStrict(data, &config)
+		if err != nil {
+			return config, errors.Wrapf(err, "parsing config file %s", path)
+		}
+	}
+
+	// The cloud can come from the environment too
+	if os.Getenv("OS_CLOUD") != "" {
+		config.OpenStack.Cloud = os.Getenv("OS_CLOUD")
+	}
+	if os.Getenv("OS_CLIENT_CONFIG_FILE") != "" {
+		config.OpenStack.CloudsFile = os.Getenv("OS_CLIENT_CONFIG_FILE")
+	}
+	if config.OpenStack.Cloud != "" {
+		err := loadCloud(&config.OpenStack)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	err := applyEnv(&config)
 	if err != nil {
-		fmt.Println("Error while Authenticating with OpenStack for the first time.")
-		log.Fatal(err)
+		return config, err
+	}
+
+	if config.Collection.InventoryInterval.Duration == 0 {
+		config.Collection.InventoryInterval = config.Collection.RefreshInterval
+	}
+	if config.Collection.HypervisorInterval.Duration == 0 {
+		config.Collection.HypervisorInterval = config.Collection.RefreshInterval
+	}
+
+	/*
+		Each target is a whole openstack section of its own, nothing is shared
+		between them, the environment only applies to the openstack section.
+	*/
+	if len(config.Targets) == 0 {
+		config.Targets = []OpenStack{config.OpenStack}
+		config.singleTarget = true
+	} else {
+		for i := range config.Targets {
+			t := &config.Targets[i]
+			defaults := openstackDefaults()
+			if t.Interface == "" {
+				t.Interface = defaults.Interface
+			}
+			if t.Scope == "" {
+				t.Scope = defaults.Scope
+			}
+			if t.Cloud != "" {
+				err := loadCloud(t)
+				if err != nil {
+					return config, errors.Wrapf(err, "targets[%d]", i)
+				}
+			}
+		}
+	}
+
+	return config, config.validate()
+}
+
+// Check the config, every problem is reported with the name of the field
+func (c Sysconfig) validate() error {
+	var problems []string
+	required := func(field string, value string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", field))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, t := range c.Targets {
+		prefix := fmt.Sprintf("targets[%d]", i)
+		if c.singleTarget {
+			prefix = "openstack"
+		}
+		problems = append(problems, t.validate(prefix)...)
+
+		// The cloud and region tags tell the targets apart
+		key := t.CloudName() + "/" + t.Region
+		if seen[key] {
+			problems = append(problems, fmt.Sprintf("%s is a second target for cloud %q region %q, set name to tell them apart", prefix, t.CloudName(), t.Region))
+		}
+		seen[key] = true
+	}
+
+	intervals := map[string]time.Duration{
+		"refresh_interval":    c.Collection.RefreshInterval.Duration,
+		"inventory_interval":  c.Collection.InventoryInterval.Duration,
+		"hypervisor_interval": c.Collection.HypervisorInterval.Duration,
+	}
+	shortest := "refresh_interval"
+	for _, name := range []string{"refresh_interval", "inventory_interval", "hypervisor_interval"} {
+		interval := intervals[name]
+		problems = append(problems, atLeast("collection."+name, interval, time.Second)...)
+		if interval < intervals[shortest] {
+			shortest = name
+		}
+	}
+	// Otherwise a late pass could still be running when the next one starts
+	if c.Collection.Jitter.Duration < 0 {
+		problems = append(problems, fmt.Sprintf("collection.jitter must not be negative, got %s", c.Collection.Jitter))
+	} else if c.Collection.Jitter.Duration >= intervals[shortest] {
+		problems = append(problems, fmt.Sprintf("collection.jitter must be shorter than collection.%s (%s), got %s", shortest, intervals[shortest], c.Collection.Jitter))
+	}
+	if c.Collection.Workers < 1 {
+		problems = append(problems, fmt.Sprintf("collection.workers must be greater than 0, got %d", c.Collection.Workers))
+	}
+	if c.Collection.RateLimit < 0 {
+		problems = append(problems, fmt.Sprintf("collection.rate_limit must not be negative, got %g", c.Collection.RateLimit))
+	}
+	if len(c.Collection.DiskDevices) == 0 {
+		problems = append(problems, "collection.disk_devices needs at least one device prefix")
+	}
+	for i, prefix := range c.Collection.DiskDevices {
+		if !diskPrefix.MatchString(prefix) {
+			problems = append(problems, fmt.Sprintf("collection.disk_devices[%d] must be a device prefix like vd or sd, got %q", i, prefix))
+		}
+	}
+	// With no ttl every lookup would list every project and domain again
+	problems = append(problems, atLeast("collection.project_cache_ttl", c.Collection.ProjectCacheTTL.Duration, time.Second)...)
+	if c.Collection.FullResync.Duration != 0 && c.Collection.FullResync.Duration < time.Second {
+		problems = append(problems, fmt.Sprintf("collection.full_resync_interval must be 0 or at least 1s, got %s", c.Collection.FullResync))
+	}
+	if _, err := regexp.Compile(c.Collection.PrimaryNetwork); err != nil {
+		problems = append(problems, fmt.Sprintf("collection.primary_network is not a valid regular expression: %s", err))
+	}
+	if c.Collection.PrimaryAddress != "fixed" && c.Collection.PrimaryAddress != "floating" {
+		problems = append(problems, fmt.Sprintf("collection.primary_address must be fixed or floating, got %q", c.Collection.PrimaryAddress))
+	}
+
+	if c.Outputs.QueueSize < 1 {
+		problems = append(problems, fmt.Sprintf("outputs.queue_size must be greater than 0, got %d", c.Outputs.QueueSize))
+	}
+	problems = append(problems, c.Filters.Include.validate("filters.include")...)
+	problems = append(problems, c.Filters.Exclude.validate("filters.exclude")...)
+	if c.Tags.MaxValues < 1 {
+		problems = append(problems, fmt.Sprintf("instance_tags.max_values must be greater than 0, got %d", c.Tags.MaxValues))
+	}
+	problems = append(problems, c.Outputs.Naming.validate()...)
+	if c.Outputs.InfluxDB.Server != "" {
+		problems = append(problems, c.Outputs.InfluxDB.validate()...)
+	}
+	if c.Outputs.InfluxDBUDP.Address != "" {
+		problems = append(problems, c.Outputs.InfluxDBUDP.validate()...)
+	}
+	if c.Outputs.OTLP.Endpoint != "" {
+		problems = append(problems, c.Outputs.OTLP.validate()...)
+	}
+	enabled := map[string]bool{
+		"influxdb":     c.Outputs.InfluxDB.Server != "",
+		"influxdb-udp": c.Outputs.InfluxDBUDP.Address != "",
+		"otlp":         c.Outputs.OTLP.Endpoint != "",
+	}
+	for _, name := range c.Outputs.Critical {
+		if !enabled[name] {
+			problems = append(problems, fmt.Sprintf("outputs.critical: %q isn't an enabled output, it has to be influxdb, influxdb-udp or otlp", name))
+		}
+	}
+	if c.Outputs.InfluxDB.Server == "" && c.Outputs.InfluxDBUDP.Address == "" && c.Outputs.OTLP.Endpoint == "" && !c.Outputs.Prometheus.Enabled {
+		problems = append(problems, "outputs needs at least one output, set outputs.influxdb.server, outputs.influxdb_udp.address, outputs.otlp.endpoint or outputs.prometheus.enabled")
+	}
+	required("web_port", c.WebPort)
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (f Filter) validate(prefix string) []string {
+	var problems []string
+	if f.Name != "" {
+		if _, err := regexp.Compile(f.Name); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.name is not a valid regular expression: %s", prefix, err))
+		}
+	}
+	for i, tag := range f.Tags {
+		// Nova takes the tags as a comma separated list
+		if tag == "" || strings.Contains(tag, ",") {
+			problems = append(problems, fmt.Sprintf("%s.tags[%d] must be a tag without commas, got %q", prefix, i, tag))
+		}
+	}
+	return problems
+}
+
+func (n Naming) validate() []string {
+	var problems []string
+	if n.Profile != "legacy" && n.Profile != "v2" {
+		problems = append(problems, fmt.Sprintf("outputs.naming.profile must be legacy or v2, got %q", n.Profile))
+	}
+	overrides := map[string]map[string]string{
+		"measurements": n.Measurements,
+		"tags":         n.Tags,
+		"fields":       n.Fields,
+	}
+	for section, names := range overrides {
+		for from, to := range names {
+			if to == "" {
+				problems = append(problems, fmt.Sprintf("outputs.naming.%s.%s can't be empty", section, from))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func (i InfluxDB) validate() []string {
+	var problems []string
+	required := func(field string, value string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("outputs.influxdb.%s is required", field))
+		}
 	}
 
-	// Just set the refresh time to 15 seconds for now.
-	config.RefreshTime = 15
+	switch i.Version {
+	case 2:
+		required("token", i.Token)
+		required("org", i.Org)
+		required("bucket", i.Bucket)
+	case 1:
+		required("database", i.Database)
+		switch i.Consistency {
+		case "", "any", "one", "quorum", "all":
+		default:
+			problems = append(problems, fmt.Sprintf("outputs.influxdb.consistency must be any, one, quorum or all, got %q", i.Consistency))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("outputs.influxdb.version must be 1 or 2, got %d", i.Version))
+	}
+	if _, ok := Precisions[i.Precision]; !ok {
+		problems = append(problems, fmt.Sprintf("outputs.influxdb.precision must be ns, us, ms or s, got %q", i.Precision))
+	}
+	if i.BatchSize < 1 {
+		problems = append(problems, fmt.Sprintf("outputs.influxdb.batch_size must be greater than 0, got %d", i.BatchSize))
+	}
+	problems = append(problems, atLeast("outputs.influxdb.flush_interval", i.FlushInterval.Duration, minFlushInterval)...)
+	if i.Spool.MaxSizeMB < 1 {
+		problems = append(problems, fmt.Sprintf("outputs.influxdb.spool.max_size_mb must be greater than 0, got %d", i.Spool.MaxSizeMB))
+	}
+	problems = append(problems, atLeast("outputs.influxdb.spool.replay_interval", i.Spool.ReplayInterval.Duration, time.Second)...)
+	return problems
+}
 
-	return provider, config
+func (u InfluxDBUDP) validate() []string {
+	var problems []string
+	if _, _, err := net.SplitHostPort(u.Address); err != nil {
+		problems = append(problems, fmt.Sprintf("outputs.influxdb_udp.address must be host:port, got %q", u.Address))
+	}
+	// Anything smaller can't hold a useful line
+	if u.PayloadSize < 64 {
+		problems = append(problems, fmt.Sprintf("outputs.influxdb_udp.payload_size must be at least 64, got %d", u.PayloadSize))
+	}
+	if _, ok := Precisions[u.Precision]; !ok {
+		problems = append(problems, fmt.Sprintf("outputs.influxdb_udp.precision must be ns, us, ms or s, got %q", u.Precision))
+	}
+	return problems
+}
+
+func (o OTLP) validate() []string {
+	var problems []string
+	u, err := url.Parse(o.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("outputs.otlp.endpoint must be an http:// or https:// url, got %q", o.Endpoint))
+	}
+	if o.Protocol != "http/protobuf" && o.Protocol != "grpc" {
+		problems = append(problems, fmt.Sprintf("outputs.otlp.protocol must be http/protobuf or grpc, got %q", o.Protocol))
+	}
+	problems = append(problems, atLeast("outputs.otlp.timeout", o.Timeout.Duration, time.Second)...)
+	if o.BatchSize < 1 {
+		problems = append(problems, fmt.Sprintf("outputs.otlp.batch_size must be greater than 0, got %d", o.BatchSize))
+	}
+	problems = append(problems, atLeast("outputs.otlp.flush_interval", o.FlushInterval.Duration, minFlushInterval)...)
+	return problems
+}
+
+// Batches can wait less than this, but not so little the flush ticker all but spins
+const minFlushInterval = 100 * time.Millisecond
+
+func atLeast(field string, value, min time.Duration) []string {
+	if value < min {
+		return []string{fmt.Sprintf("%s must be at least %s, got %s", field, min, value)}
+	}
+	return nil
+}
+
+// TLSConfig for talking to the collector over https, nil when the defaults will do
+func (o OTLP) TLSConfig() (*tls.Config, error) {
+	if o.CACert == "" && !o.Insecure {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: o.Insecure}
+	if o.CACert != "" {
+		pem, err := ioutil.ReadFile(o.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading outputs.otlp.cacert")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("outputs.otlp.cacert %s has no PEM certificates", o.CACert)
+		}
+	}
+	return config, nil
+}
+
+// Precisions are the timestamp precisions InfluxDB understands
+var Precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+func (o OpenStack) validate(prefix string) []string {
+	var problems []string
+	required := func(field string, value string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s.%s is required", prefix, field))
+		}
+	}
+
+	required("auth_url", o.AuthURL)
+	switch {
+	case o.appCredential():
+		required("application_credential_secret", o.ApplicationCredentialSecret)
+		if o.ApplicationCredentialID == "" {
+			required("username", o.Username)
+		}
+	case o.Token != "":
+	default:
+		required("username", o.Username)
+		required("password", o.Password)
+	}
+	if !o.appCredential() && o.ProjectID == "" && o.ProjectName == "" {
+		problems = append(problems, fmt.Sprintf("%s.project_id or %s.project_name is required", prefix, prefix))
+	}
+	if (o.Cert == "") != (o.Key == "") {
+		problems = append(problems, fmt.Sprintf("%s.cert and %s.key have to be set together", prefix, prefix))
+	}
+	if o.Scope != "site" && o.Scope != "project" {
+		problems = append(problems, fmt.Sprintf("%s.scope must be site or project, got %q", prefix, o.Scope))
+	}
+	return problems
+}
+
+// EndpointOpts picks the region and interface to use from the service catalog.
+func (o OpenStack) EndpointOpts() gophercloud.EndpointOpts {
+	return gophercloud.EndpointOpts{
+		Region:       o.Region,
+		Availability: gophercloud.Availability(o.Interface),
+	}
 }
 
 /*
-Authenticate using the Enviromental vars
+Authenticate using the configured credentials
 Return ProviderClient and err
 */
-func osAuth() (*gophercloud.ProviderClient, error) {
-	// Lets connect to Openstack now using these values
-	opts, err := openstack.AuthOptionsFromEnv()
+func Authenticate(o OpenStack) (*gophercloud.ProviderClient, error) {
+	opts := gophercloud.AuthOptions{
+		IdentityEndpoint: o.AuthURL,
+		DomainID:         o.UserDomainID,
+		DomainName:       o.UserDomainName,
+		// This is super important, because the token will expire.
+		// (Except for plain tokens, there is nothing to get a new one with)
+		AllowReauth: true,
+	}
+
+	switch {
+	case o.appCredential():
+		opts.ApplicationCredentialID = o.ApplicationCredentialID
+		opts.ApplicationCredentialName = o.ApplicationCredentialName
+		opts.ApplicationCredentialSecret = o.ApplicationCredentialSecret
+		if o.ApplicationCredentialID == "" {
+			opts.Username = o.Username
+		}
+	case o.Token != "":
+		opts.TokenID = o.Token
+		opts.AllowReauth = false
+	default:
+		opts.Username = o.Username
+		opts.Password = o.Password
+	}
+
+	// Application credentials carry their own scope
+	if !o.appCredential() {
+		opts.TenantID = o.ProjectID
+		// Scoping by name needs the project's domain, which may not be the user's
+		if o.ProjectID == "" {
+			opts.Scope = &gophercloud.AuthScope{
+				ProjectName: o.ProjectName,
+				DomainID:    o.ProjectDomainID,
+				DomainName:  o.ProjectDomainName,
+			}
+			if opts.Scope.DomainID == "" && opts.Scope.DomainName == "" {
+				opts.Scope.DomainID = o.UserDomainID
+				opts.Scope.DomainName = o.UserDomainName
+			}
+		}
+	}
+
+	provider, err := openstack.NewClient(o.AuthURL)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		// Keeping the timeouts, connection pooling and http/2 of the default transport
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		provider.HTTPClient.Transport = transport
 	}
-	// This is super important, because the token will expire.
-	opts.AllowReauth = true
 
-	provider, err := openstack.AuthenticatedClient(opts)
+	err = openstack.Authenticate(provider, opts)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	r := provider.GetAuthResult()
 	if r == nil {
 		return nil, errors.New("no valid auth result")
 	}
-	return provider, err
+	return provider, nil
+}
+
+// Custom CA bundle, client certificate or no verification, nil if none of them are set
+func (o OpenStack) tlsConfig() (*tls.Config, error) {
+	if o.CACert == "" && o.Cert == "" && !o.Insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: o.Insecure}
+	if o.CACert != "" {
+		pem, err := ioutil.ReadFile(o.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading openstack.cacert")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("openstack.cacert %s has no PEM certificates", o.CACert)
+		}
+	}
+	if o.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading openstack.cert and openstack.key")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
 }
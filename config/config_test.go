@@ -0,0 +1,173 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestDurationYAML(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want time.Duration
+		err  bool
+	}{
+		{"d: 30s", 30 * time.Second, false},
+		{"d: 1m30s", 90 * time.Second, false},
+		{"d: 250ms", 250 * time.Millisecond, false},
+		// what the environment variables have always taken
+		{"d: 30", 30 * time.Second, false},
+		{"d: \"10\"", 10 * time.Second, false},
+		{"d: 0", 0, false},
+		{"d: 1.5", 0, true},
+		{"d: soon", 0, true},
+		{"d: [1]", 0, true},
+	}
+	for _, tt := range tests {
+		var v struct {
+			D Duration `yaml:"d"`
+		}
+		err := yaml.UnmarshalStrict([]byte(tt.yaml), &v)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.yaml, err, tt.err)
+			continue
+		}
+		if v.D.Duration != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.yaml, v.D.Duration, tt.want)
+		}
+	}
+}
+
+// Verifying against our own CA, or not at all, keeps what the default transport does otherwise
+func TestAuthenticateTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Subject-Token", "token")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"token": {"expires_at": "2099-01-01T00:00:00.000000Z", "catalog": []}}`)
+	}))
+	defer srv.Close()
+
+	o := OpenStack{
+		AuthURL:        srv.URL + "/v3/",
+		Username:       "stats",
+		Password:       "secret",
+		UserDomainName: "Default",
+		ProjectID:      "p1",
+		Insecure:       true,
+	}
+	provider, err := Authenticate(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, ok := provider.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transport is a %T", provider.HTTPClient.Transport)
+	}
+	defaults := http.DefaultTransport.(*http.Transport)
+	if transport.TLSHandshakeTimeout != defaults.TLSHandshakeTimeout || transport.IdleConnTimeout != defaults.IdleConnTimeout ||
+		transport.MaxIdleConns != defaults.MaxIdleConns || !transport.ForceAttemptHTTP2 || transport.DialContext == nil || transport.Proxy == nil {
+		t.Error("the transport lost the defaults")
+	}
+	if !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Error("insecure wasn't applied")
+	}
+}
+
+// A config that passes validate, for the tests to break one thing at a time
+func validConfig() Sysconfig {
+	c := defaults()
+	c.OpenStack.AuthURL = "https://keystone.example.com/v3"
+	c.OpenStack.Username = "stats"
+	c.OpenStack.Password = "secret"
+	c.OpenStack.ProjectID = "p1"
+	c.Targets = []OpenStack{c.OpenStack}
+	c.singleTarget = true
+	c.Collection.InventoryInterval = c.Collection.RefreshInterval
+	c.Collection.HypervisorInterval = c.Collection.RefreshInterval
+	c.Outputs.InfluxDB.Server = "http://influxdb:8086"
+	c.Outputs.InfluxDB.Token = "token"
+	c.Outputs.InfluxDB.Org = "org"
+	c.Outputs.InfluxDB.Bucket = "bucket"
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Sysconfig)
+		err    string // part of the error, empty when it's valid
+	}{
+		{"valid", func(c *Sysconfig) {}, ""},
+		{"no auth url", func(c *Sysconfig) { c.Targets[0].AuthURL = "" }, "openstack.auth_url is required"},
+		{"no project", func(c *Sysconfig) { c.Targets[0].ProjectID = "" }, "openstack.project_id or openstack.project_name is required"},
+		{"token instead of a password", func(c *Sysconfig) { c.Targets[0].Token, c.Targets[0].Username, c.Targets[0].Password = "t", "", "" }, ""},
+		{"application credential", func(c *Sysconfig) {
+			c.Targets[0].ApplicationCredentialID, c.Targets[0].ApplicationCredentialSecret, c.Targets[0].ProjectID = "id", "s", ""
+		}, ""},
+		{"cert without a key", func(c *Sysconfig) { c.Targets[0].Cert = "client.pem" }, "openstack.cert and openstack.key have to be set together"},
+		{"bad scope", func(c *Sysconfig) { c.Targets[0].Scope = "world" }, `openstack.scope must be site or project, got "world"`},
+		{"same target twice", func(c *Sysconfig) { c.Targets = append(c.Targets, c.Targets[0]); c.singleTarget = false }, "targets[1] is a second target"},
+		{"short interval", func(c *Sysconfig) { c.Collection.InventoryInterval = Duration{time.Millisecond} }, "collection.inventory_interval must be at least 1s, got 1ms"},
+		{"jitter too long", func(c *Sysconfig) { c.Collection.Jitter = Duration{15 * time.Second} }, "collection.jitter must be shorter than collection.refresh_interval"},
+		{"negative jitter", func(c *Sysconfig) { c.Collection.Jitter = Duration{-time.Second} }, "collection.jitter must not be negative"},
+		{"no workers", func(c *Sysconfig) { c.Collection.Workers = 0 }, "collection.workers must be greater than 0"},
+		{"negative rate limit", func(c *Sysconfig) { c.Collection.RateLimit = -1 }, "collection.rate_limit must not be negative"},
+		{"no disk devices", func(c *Sysconfig) { c.Collection.DiskDevices = nil }, "collection.disk_devices needs at least one device prefix"},
+		{"bad disk device", func(c *Sysconfig) { c.Collection.DiskDevices = []string{"vd", "v.*"} }, "collection.disk_devices[1] must be a device prefix"},
+		{"no project cache", func(c *Sysconfig) { c.Collection.ProjectCacheTTL = Duration{} }, "collection.project_cache_ttl must be at least 1s"},
+		{"no full resync", func(c *Sysconfig) { c.Collection.FullResync = Duration{} }, ""},
+		{"short full resync", func(c *Sysconfig) { c.Collection.FullResync = Duration{time.Millisecond} }, "collection.full_resync_interval must be 0 or at least 1s"},
+		{"bad primary network", func(c *Sysconfig) { c.Collection.PrimaryNetwork = "(" }, "collection.primary_network is not a valid regular expression"},
+		{"bad primary address", func(c *Sysconfig) { c.Collection.PrimaryAddress = "any" }, "collection.primary_address must be fixed or floating"},
+		{"bad filter name", func(c *Sysconfig) { c.Filters.Exclude.Name = "(" }, "filters.exclude.name is not a valid regular expression"},
+		{"filter tag with a comma", func(c *Sysconfig) { c.Filters.Include.Tags = []string{"a,b"} }, "filters.include.tags[0] must be a tag without commas"},
+		{"no tag values", func(c *Sysconfig) { c.Tags.MaxValues = 0 }, "instance_tags.max_values must be greater than 0"},
+		{"no queue", func(c *Sysconfig) { c.Outputs.QueueSize = 0 }, "outputs.queue_size must be greater than 0"},
+		{"unknown naming profile", func(c *Sysconfig) { c.Outputs.Naming.Profile = "v3" }, `outputs.naming.profile must be legacy or v2, got "v3"`},
+		{"empty name override", func(c *Sysconfig) { c.Outputs.Naming.Tags = map[string]string{"UUID": ""} }, "outputs.naming.tags.UUID can't be empty"},
+		{"influxdb 2 without a bucket", func(c *Sysconfig) { c.Outputs.InfluxDB.Bucket = "" }, "outputs.influxdb.bucket is required"},
+		{"influxdb 1", func(c *Sysconfig) { c.Outputs.InfluxDB.Version = 1; c.Outputs.InfluxDB.Database = "stats" }, ""},
+		{"influxdb 1 consistency", func(c *Sysconfig) {
+			c.Outputs.InfluxDB.Version = 1
+			c.Outputs.InfluxDB.Database = "stats"
+			c.Outputs.InfluxDB.Consistency = "most"
+		}, "outputs.influxdb.consistency must be any, one, quorum or all"},
+		{"influxdb 3", func(c *Sysconfig) { c.Outputs.InfluxDB.Version = 3 }, "outputs.influxdb.version must be 1 or 2"},
+		{"bad precision", func(c *Sysconfig) { c.Outputs.InfluxDB.Precision = "m" }, "outputs.influxdb.precision must be ns, us, ms or s"},
+		{"short flush", func(c *Sysconfig) { c.Outputs.InfluxDB.FlushInterval = Duration{time.Millisecond} }, "outputs.influxdb.flush_interval must be at least 100ms"},
+		{"udp address", func(c *Sysconfig) { c.Outputs.InfluxDBUDP.Address = "influxdb" }, "outputs.influxdb_udp.address must be host:port"},
+		{"udp payload", func(c *Sysconfig) {
+			c.Outputs.InfluxDBUDP.Address = "influxdb:8089"
+			c.Outputs.InfluxDBUDP.PayloadSize = 10
+		}, "outputs.influxdb_udp.payload_size must be at least 64"},
+		{"otlp endpoint", func(c *Sysconfig) { c.Outputs.OTLP.Endpoint = "collector:4318" }, "outputs.otlp.endpoint must be an http:// or https:// url"},
+		{"otlp protocol", func(c *Sysconfig) {
+			c.Outputs.OTLP.Endpoint = "http://collector:4318"
+			c.Outputs.OTLP.Protocol = "thrift"
+		}, "outputs.otlp.protocol must be http/protobuf or grpc"},
+		{"critical output", func(c *Sysconfig) { c.Outputs.Critical = []string{"influxdb"} }, ""},
+		{"critical output not enabled", func(c *Sysconfig) { c.Outputs.Critical = []string{"otlp"} }, `outputs.critical: "otlp" isn't an enabled output`},
+		{"no outputs", func(c *Sysconfig) { c.Outputs.InfluxDB.Server = ""; c.Outputs.Prometheus.Enabled = false }, "outputs needs at least one output"},
+		{"only prometheus", func(c *Sysconfig) { c.Outputs.InfluxDB.Server = "" }, ""},
+		{"no web port", func(c *Sysconfig) { c.WebPort = "" }, "web_port is required"},
+	}
+	for _, tt := range tests {
+		c := validConfig()
+		tt.change(&c)
+		err := c.validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: valid, want %q", tt.name, tt.err)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: %s, want %q", tt.name, err, tt.err)
+		}
+	}
+}
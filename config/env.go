@@ -0,0 +1,125 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Environment variables override the config file. These are the same names the
+program has always used, along with the standard OpenStack OS_* ones.
+*/
+func applyEnv(c *Sysconfig) error {
+	strs := map[string]*string{
+		"OS_AUTH_URL": &c.OpenStack.AuthURL,
+		"OS_USERNAME": &c.OpenStack.Username,
+		"OS_PASSWORD": &c.OpenStack.Password,
+		"OS_TOKEN":    &c.OpenStack.Token,
+		"OS_CACERT":   &c.OpenStack.CACert,
+		"OS_CERT":     &c.OpenStack.Cert,
+		"OS_KEY":      &c.OpenStack.Key,
+
+		"OS_APPLICATION_CREDENTIAL_ID":     &c.OpenStack.ApplicationCredentialID,
+		"OS_APPLICATION_CREDENTIAL_NAME":   &c.OpenStack.ApplicationCredentialName,
+		"OS_APPLICATION_CREDENTIAL_SECRET": &c.OpenStack.ApplicationCredentialSecret,
+		"OS_USER_DOMAIN_NAME":              &c.OpenStack.UserDomainName,
+		"OS_USER_DOMAIN_ID":                &c.OpenStack.UserDomainID,
+		"OS_PROJECT_ID":                    &c.OpenStack.ProjectID,
+		"OS_PROJECT_NAME":                  &c.OpenStack.ProjectName,
+		"OS_PROJECT_DOMAIN_NAME":           &c.OpenStack.ProjectDomainName,
+		"OS_PROJECT_DOMAIN_ID":             &c.OpenStack.ProjectDomainID,
+		"OS_REGION_NAME":                   &c.OpenStack.Region,
+		"OS_INTERFACE":                     &c.OpenStack.Interface,
+		"SCOPE":                            &c.OpenStack.Scope,
+		"INFLUX_SERVER":                    &c.Outputs.InfluxDB.Server,
+		"INFLUX_TOKEN":                     &c.Outputs.InfluxDB.Token,
+		"INFLUX_ORG":                       &c.Outputs.InfluxDB.Org,
+		"INFLUX_BUCKET":                    &c.Outputs.InfluxDB.Bucket,
+		"INFLUX_DATABASE":                  &c.Outputs.InfluxDB.Database,
+		"INFLUX_RETENTION_POLICY":          &c.Outputs.InfluxDB.RetentionPolicy,
+		"INFLUX_USERNAME":                  &c.Outputs.InfluxDB.Username,
+		"INFLUX_PASSWORD":                  &c.Outputs.InfluxDB.Password,
+		"INFLUX_SPOOL_DIR":                 &c.Outputs.InfluxDB.Spool.Dir,
+		"INFLUX_UDP_ADDRESS":               &c.Outputs.InfluxDBUDP.Address,
+		"OTEL_EXPORTER_OTLP_ENDPOINT":      &c.Outputs.OTLP.Endpoint,
+		"OTEL_EXPORTER_OTLP_PROTOCOL":      &c.Outputs.OTLP.Protocol,
+		"NAMING_PROFILE":                   &c.Outputs.Naming.Profile,
+		"STATS_PORT":                       &c.WebPort,
+	}
+	for name, field := range strs {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	// Older OpenStack rc files only have OS_DOMAIN_NAME for the user's domain
+	if c.OpenStack.UserDomainName == "" && os.Getenv("OS_DOMAIN_NAME") != "" {
+		c.OpenStack.UserDomainName = os.Getenv("OS_DOMAIN_NAME")
+	}
+
+	if v := os.Getenv("INFLUX_VERSION"); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("INFLUX_VERSION must be a number, got %q", v)
+		}
+		c.Outputs.InfluxDB.Version = version
+	}
+	if v := os.Getenv("STATS_WORKERS"); v != "" {
+		workers, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("STATS_WORKERS must be a number, got %q", v)
+		}
+		c.Collection.Workers = workers
+	}
+	if v := os.Getenv("STATS_RATE_LIMIT"); v != "" {
+		limit, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("STATS_RATE_LIMIT must be a number, got %q", v)
+		}
+		c.Collection.RateLimit = limit
+	}
+	if v := os.Getenv("STATS_ALIGN"); v != "" {
+		align, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("STATS_ALIGN must be true or false, got %q", v)
+		}
+		c.Collection.Align = align
+	}
+	if v := os.Getenv("DISK_DEVICES"); v != "" {
+		c.Collection.DiskDevices = strings.Split(v, ",")
+	}
+	if v := os.Getenv("PRIMARY_NETWORK"); v != "" {
+		c.Collection.PrimaryNetwork = v
+	}
+
+	durations := map[string]*time.Duration{
+		"STATS_REFRESH_INTERVAL": &c.Collection.RefreshInterval.Duration,
+		"INVENTORY_INTERVAL":     &c.Collection.InventoryInterval.Duration,
+		"HYPERVISOR_INTERVAL":    &c.Collection.HypervisorInterval.Duration,
+		"STATS_JITTER":           &c.Collection.Jitter.Duration,
+		"PROJECT_CACHE_TTL":      &c.Collection.ProjectCacheTTL.Duration,
+		"FULL_RESYNC_INTERVAL":   &c.Collection.FullResync.Duration,
+	}
+	for name, field := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := parseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s must be a duration like 30s or a number of seconds, got %q", name, v)
+			}
+			*field = d
+		}
+	}
+
+	return nil
+}
+
+// A plain number is seconds, which is what these used to be
+func parseDuration(v string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
@@ -0,0 +1,173 @@
+package filter
+
+import (
+	"regexp"
+	"strings"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+)
+
+// Instance is what the filters look at
+type Instance struct {
+	ProjectID        string
+	ProjectName      string
+	Name             string
+	Metadata         map[string]string
+	Tags             []string
+	AvailabilityZone string
+}
+
+/*
+Filter decides which instances are collected. An instance has to match every
+include rule that's set, and is dropped when it matches any exclude rule.
+*/
+type Filter struct {
+	include rules
+	exclude rules
+}
+
+type rules struct {
+	projects map[string]bool
+	name     *regexp.Regexp
+	metadata map[string]string
+	tags     []string
+	zones    map[string]bool
+}
+
+func New(conf config.Filters) (*Filter, error) {
+	include, err := newRules(conf.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := newRules(conf.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{include: include, exclude: exclude}, nil
+}
+
+func newRules(conf config.Filter) (rules, error) {
+	r := rules{
+		projects: set(conf.Projects),
+		metadata: conf.Metadata,
+		tags:     conf.Tags,
+		zones:    set(conf.AvailabilityZones),
+	}
+	if conf.Name != "" {
+		var err error
+		r.name, err = regexp.Compile(conf.Name)
+		if err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+func set(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	s := make(map[string]bool, len(values))
+	for _, v := range values {
+		s[v] = true
+	}
+	return s
+}
+
+/*
+ListOpts pushes what Nova can filter on itself into the server list, so we
+don't download instances we'd throw away. Everything is still checked again
+by Match, Nova ignores some of these for non admins. The tag filters need
+microversion 2.26.
+*/
+func (f *Filter) ListOpts(opts *servers.ListOpts, tagsSupported bool) {
+	if tagsSupported {
+		if len(f.include.tags) > 0 {
+			opts.Tags = strings.Join(f.include.tags, ",")
+		}
+		// Only servers that have none of these tags
+		if len(f.exclude.tags) > 0 {
+			opts.NotTagsAny = strings.Join(f.exclude.tags, ",")
+		}
+	}
+	if f.include.name != nil {
+		opts.Name = f.include.name.String()
+	}
+	if len(f.include.zones) == 1 {
+		for zone := range f.include.zones {
+			opts.AvailabilityZone = zone
+		}
+	}
+	// Names can't be pushed down, only a project id and only across all tenants
+	if len(f.include.projects) == 1 && opts.AllTenants {
+		for project := range f.include.projects {
+			if projectID.MatchString(project) {
+				opts.TenantID = project
+			}
+		}
+	}
+}
+
+// Keystone project ids are uuids without the dashes
+var projectID = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// Match reports whether the instance should be collected
+func (f *Filter) Match(i Instance) bool {
+	return f.include.all(i) && !f.exclude.any(i)
+}
+
+// Every rule that's set matches
+func (r rules) all(i Instance) bool {
+	if r.projects != nil && !r.projects[i.ProjectID] && !r.projects[i.ProjectName] {
+		return false
+	}
+	if r.name != nil && !r.name.MatchString(i.Name) {
+		return false
+	}
+	for k, v := range r.metadata {
+		value, found := i.Metadata[k]
+		if !found || (v != "" && value != v) {
+			return false
+		}
+	}
+	for _, tag := range r.tags {
+		if !contains(i.Tags, tag) {
+			return false
+		}
+	}
+	if r.zones != nil && !r.zones[i.AvailabilityZone] {
+		return false
+	}
+	return true
+}
+
+// Any rule that's set matches
+func (r rules) any(i Instance) bool {
+	if r.projects[i.ProjectID] || (i.ProjectName != "" && r.projects[i.ProjectName]) {
+		return true
+	}
+	if r.name != nil && r.name.MatchString(i.Name) {
+		return true
+	}
+	for k, v := range r.metadata {
+		if value, found := i.Metadata[k]; found && (v == "" || value == v) {
+			return true
+		}
+	}
+	for _, tag := range r.tags {
+		if contains(i.Tags, tag) {
+			return true
+		}
+	}
+	return i.AvailabilityZone != "" && r.zones[i.AvailabilityZone]
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package filter
+
+import (
+	"testing"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+)
+
+func TestMatch(t *testing.T) {
+	web := Instance{
+		ProjectID:        "0123456789abcdef0123456789abcdef",
+		ProjectName:      "web",
+		Name:             "web-1",
+		Metadata:         map[string]string{"team": "frontend", "env": "prod"},
+		Tags:             []string{"monitored"},
+		AvailabilityZone: "az1",
+	}
+	tests := []struct {
+		name    string
+		filters config.Filters
+		want    bool
+	}{
+		{"no filters", config.Filters{}, true},
+		{"project by id", config.Filters{Include: config.Filter{Projects: []string{"0123456789abcdef0123456789abcdef"}}}, true},
+		{"project by name", config.Filters{Include: config.Filter{Projects: []string{"web"}}}, true},
+		{"other project", config.Filters{Include: config.Filter{Projects: []string{"db"}}}, false},
+		{"name", config.Filters{Include: config.Filter{Name: "^web-"}}, true},
+		{"other name", config.Filters{Include: config.Filter{Name: "^db-"}}, false},
+		{"metadata value", config.Filters{Include: config.Filter{Metadata: map[string]string{"team": "frontend"}}}, true},
+		{"any metadata value", config.Filters{Include: config.Filter{Metadata: map[string]string{"env": ""}}}, true},
+		{"other metadata value", config.Filters{Include: config.Filter{Metadata: map[string]string{"team": "backend"}}}, false},
+		{"missing metadata", config.Filters{Include: config.Filter{Metadata: map[string]string{"owner": ""}}}, false},
+		{"tag", config.Filters{Include: config.Filter{Tags: []string{"monitored"}}}, true},
+		{"every tag", config.Filters{Include: config.Filter{Tags: []string{"monitored", "billed"}}}, false},
+		{"zone", config.Filters{Include: config.Filter{AvailabilityZones: []string{"az1", "az2"}}}, true},
+		{"other zone", config.Filters{Include: config.Filter{AvailabilityZones: []string{"az2"}}}, false},
+		{"every include rule", config.Filters{Include: config.Filter{Name: "^web-", AvailabilityZones: []string{"az2"}}}, false},
+		{"excluded by tag", config.Filters{Exclude: config.Filter{Tags: []string{"monitored"}}}, false},
+		{"excluded by any rule", config.Filters{Exclude: config.Filter{Name: "^db-", Metadata: map[string]string{"env": "prod"}}}, false},
+		{"not excluded", config.Filters{Exclude: config.Filter{Name: "^db-", AvailabilityZones: []string{"az2"}}}, true},
+		{"included then excluded", config.Filters{Include: config.Filter{Projects: []string{"web"}}, Exclude: config.Filter{Name: "-1$"}}, false},
+	}
+	for _, tt := range tests {
+		f, err := New(tt.filters)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := f.Match(web); got != tt.want {
+			t.Errorf("%s: Match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Excluding a project by name doesn't catch instances whose project name we don't know
+	f, err := New(config.Filters{Exclude: config.Filter{Projects: []string{""}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match(Instance{ProjectID: "p1"}) {
+		t.Error("an instance without a project name was excluded")
+	}
+}
+
+func TestNewBadName(t *testing.T) {
+	if _, err := New(config.Filters{Include: config.Filter{Name: "web-("}}); err == nil {
+		t.Error("a name that isn't a regular expression was taken")
+	}
+}
+
+func TestListOpts(t *testing.T) {
+	project := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name       string
+		filters    config.Filters
+		allTenants bool
+		tags       bool
+		want       servers.ListOpts
+	}{
+		{"nothing to push down", config.Filters{}, true, true, servers.ListOpts{AllTenants: true}},
+		{"tags", config.Filters{Include: config.Filter{Tags: []string{"a", "b"}}, Exclude: config.Filter{Tags: []string{"c"}}}, false, true,
+			servers.ListOpts{Tags: "a,b", NotTagsAny: "c"}},
+		{"tags before 2.26", config.Filters{Include: config.Filter{Tags: []string{"a"}}}, false, false, servers.ListOpts{}},
+		{"name and one zone", config.Filters{Include: config.Filter{Name: "^web-", AvailabilityZones: []string{"az1"}}}, false, true,
+			servers.ListOpts{Name: "^web-", AvailabilityZone: "az1"}},
+		{"more than one zone", config.Filters{Include: config.Filter{AvailabilityZones: []string{"az1", "az2"}}}, false, true, servers.ListOpts{}},
+		{"project id across all tenants", config.Filters{Include: config.Filter{Projects: []string{project}}}, true, true,
+			servers.ListOpts{AllTenants: true, TenantID: project}},
+		{"project name", config.Filters{Include: config.Filter{Projects: []string{"web"}}}, true, true, servers.ListOpts{AllTenants: true}},
+		{"project id in our own project", config.Filters{Include: config.Filter{Projects: []string{project}}}, false, true, servers.ListOpts{}},
+	}
+	for _, tt := range tests {
+		f, err := New(tt.filters)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		opts := servers.ListOpts{AllTenants: tt.allTenants}
+		f.ListOpts(&opts, tt.tags)
+		if opts != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, opts, tt.want)
+		}
+	}
+}
@@ -1,17 +1,17 @@
 module github.com/cheetahfox/openstack-instance-stats
 
-go 1.17
+go 1.24.0
 
 require (
 	github.com/gophercloud/gophercloud v0.24.0
 	github.com/gorilla/mux v1.8.0
 	github.com/influxdata/influxdb-client-go/v2 v2.9.0
 	github.com/pkg/errors v0.9.1
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
 	github.com/deepmap/oapi-codegen v1.8.2 // indirect
 	github.com/influxdata/line-protocol v0.0.0-20200327222509-2487e7298839 // indirect
 	golang.org/x/net v0.38.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -1,18 +1,24 @@
 package handlers
 
 import (
+	"net/http"
 	"sync/atomic"
 	"time"
 
+	"github.com/cheetahfox/openstack-instance-stats/sink"
 	"github.com/gorilla/mux"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 )
 
-func Router(dbclient influxdb2.Client) *mux.Router {
+/*
+Router sets up the health checks and the prometheus scrape endpoint when
+metricsHandler isn't nil. Readiness follows the collection, and only the
+outputs that were made critical.
+*/
+func Router(collection, outputs sink.Checker, metricsHandler http.Handler) *mux.Router {
 	isReady := &atomic.Value{}
 	isReady.Store(false)
 
-	// Startup and wait 10 seconds before checking to see if the influxDB is good
+	// Startup and wait 10 seconds before checking to see if the collection and outputs are good
 	go func() {
 		time.Sleep(10 * time.Second)
 		isReady.Store(true)
@@ -20,7 +26,10 @@ func Router(dbclient influxdb2.Client) *mux.Router {
 
 	r := mux.NewRouter()
 	r.HandleFunc("/healthz", healthz)
-	r.HandleFunc("/readyz", readyz(isReady, dbclient))
+	r.HandleFunc("/readyz", readyz(isReady, collection, outputs))
+	if metricsHandler != nil {
+		r.Handle("/metrics", metricsHandler)
+	}
 
 	return r
 }
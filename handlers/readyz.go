@@ -5,16 +5,18 @@ import (
 	"net/http"
 	"sync/atomic"
 
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/domain"
+	"github.com/cheetahfox/openstack-instance-stats/sink"
 )
 
-// Ready Check where we look at the database status or the initial ready delay.
-func readyz(isReady *atomic.Value, dbclient influxdb2.Client) http.HandlerFunc {
+// Ready Check where we look at the collection and critical output status or the initial ready delay.
+func readyz(isReady *atomic.Value, collection, outputs sink.Checker) http.HandlerFunc {
 	return func(w http.ResponseWriter, _ *http.Request) {
-		// Check database Status. If unhealthy return a http error status
-		health, err := dbclient.Health(context.Background())
-		if (err != nil) || health.Status != domain.HealthCheckStatusPass {
+		// Check the collection and outputs Status. If unhealthy return a http error status
+		err := collection.Health(context.Background())
+		if err == nil {
+			err = outputs.Health(context.Background())
+		}
+		if err != nil {
 			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 			return
 		}
@@ -1,46 +1,303 @@
 package influx
 
 import (
-	"time"
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	config "github.com/cheetahfox/openstack-instance-stats/config"
-	metrics "github.com/cheetahfox/openstack-instance-stats/metrics"
+	"github.com/cheetahfox/openstack-instance-stats/sink"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/influxdata/influxdb-client-go/v2/domain"
 )
 
-var writeAPI api.WriteAPI
-var client influxdb2.Client 
-
-func SetupInfluxDB(conf config.Sysconfig) {
-	dbclient := influxdb2.NewClient(conf.InfluxdbServer, conf.Token)
-	health, err := dbclient.Health(context.Background())
-	if (err != nil) && health.Status == domain.HealthCheckStatusPass {
-		log.Panic(err)
-	}
-	writeAPI := dbclient.WriteAPI(conf.Org, conf.Bucket)
-	errorsCh := writeAPI.Errors()
-	// Catch any write errors
-	go func() {
-		for err := range errorsCh {
-			fmt.Printf("write error: %s\n", err.Error())
-		}
-	}()
-}
-
-// This writes a point that we have computed from the normal statistics
-func WritePoint(s metrics.Vms, m string, f string, v float64, dbapi api.WriteAPI) {
-	t := time.Now()
-	p := influxdb2.NewPointWithMeasurement(m).
-		AddTag("Instance Name", s.Name).
-		AddTag("UUID", s.UUID).
-		AddTag("Project", s.ProjectID).
-		AddField(f, v).
-		SetTime(t)
-	dbapi.WritePoint(p)
-	// fmt.Println("Wrote Data for "+f+" : %f : at", v, t.String())
-}
\ No newline at end of file
+/*
+Sink writes the samples to an InfluxDB 2 bucket or an InfluxDB 1.x database.
+Samples are gathered into batches of batch_size points, or whatever we have
+every flush_interval, and each batch is written in one blocking request so we
+know when it failed. With a spool directory failed batches are kept on disk and
+replayed in order once the health check passes again, otherwise they are dropped.
+*/
+type Sink struct {
+	conf      config.InfluxDB
+	naming    *sink.Naming
+	precision time.Duration
+	out       writer
+	spool     *spool // nil without a spool directory
+
+	mu      sync.Mutex
+	pending strings.Builder
+	points  int
+
+	flushMu sync.Mutex // batches go out one at a time, in order
+	written uint64
+	dropped uint64 // points lost to write failures without a spool or that were rejected
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// writer sends a batch of line protocol to InfluxDB, there's one for each api version
+type writer interface {
+	write(ctx context.Context, batch string) error
+	health(ctx context.Context) error
+	close()
+}
+
+func New(conf config.InfluxDB, naming *sink.Naming) (*Sink, error) {
+	s := &Sink{
+		conf:      conf,
+		naming:    naming,
+		precision: config.Precisions[conf.Precision],
+		done:      make(chan struct{}),
+	}
+	if conf.Version == 1 {
+		var err error
+		s.out, err = newV1(conf)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.out = newV2(conf, s.precision)
+	}
+
+	if conf.Spool.Dir != "" {
+		var err error
+		s.spool, err = openSpool(conf.Spool.Dir, int64(conf.Spool.MaxSizeMB)<<20)
+		if err != nil {
+			s.out.close()
+			return nil, err
+		}
+		if n := s.spool.Len(); n > 0 {
+			log.Printf("Found %d spooled InfluxDB batches in %s\n", n, conf.Spool.Dir)
+		}
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return "influxdb"
+}
+
+// Write adds the samples to the pending batch, it's only sent once it's full or on the next flush
+func (s *Sink) Write(samples []sink.Sample) error {
+	s.mu.Lock()
+	for _, sample := range samples {
+		s.pending.WriteString(lineProtocol(sample, s.naming, s.precision))
+		s.points++
+	}
+	full := s.points >= s.conf.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		s.flush()
+	}
+	return nil
+}
+
+func (s *Sink) Health(ctx context.Context) error {
+	return s.out.health(ctx)
+}
+
+// Stats are exported on /metrics so we can see when InfluxDB has been falling behind
+func (s *Sink) Stats() map[string]float64 {
+	stats := map[string]float64{
+		"written_points_total": float64(atomic.LoadUint64(&s.written)),
+		"dropped_points_total": float64(atomic.LoadUint64(&s.dropped)),
+	}
+	if s.spool != nil {
+		for k, v := range s.spool.Stats() {
+			stats[k] = v
+		}
+	}
+	return stats
+}
+
+// Close sends whatever is pending, anything that fails stays in the spool for next time
+func (s *Sink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	s.flush()
+	s.out.close()
+	return nil
+}
+
+func (s *Sink) run() {
+	defer s.wg.Done()
+	flush := time.NewTicker(s.conf.FlushInterval.Duration)
+	defer flush.Stop()
+	replay := time.NewTicker(s.conf.Spool.ReplayInterval.Duration)
+	defer replay.Stop()
+
+	for {
+		select {
+		case <-flush.C:
+			s.flush()
+		case <-replay.C:
+			s.replay()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Sink) flush() {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	batch := s.pending.String()
+	points := s.points
+	s.pending.Reset()
+	s.points = 0
+	s.mu.Unlock()
+	if points == 0 {
+		return
+	}
+
+	// While there's a backlog everything new goes behind it to keep the order
+	if s.spool != nil && s.spool.Len() > 0 {
+		s.spoolBatch(batch, points)
+		return
+	}
+
+	err := s.out.write(context.Background(), batch)
+	if err == nil {
+		atomic.AddUint64(&s.written, uint64(points))
+		return
+	}
+	fmt.Printf("write error: %s\n", err.Error())
+	if s.spool == nil || rejected(err) {
+		atomic.AddUint64(&s.dropped, uint64(points))
+		return
+	}
+	s.spoolBatch(batch, points)
+}
+
+func (s *Sink) spoolBatch(batch string, points int) {
+	err := s.spool.Append(batch)
+	if err != nil {
+		log.Println(err)
+		log.Printf("Error while spooling %d points to %s\n", points, s.conf.Spool.Dir)
+	}
+}
+
+// Once InfluxDB is healthy again write the spooled batches back, oldest first
+func (s *Sink) replay() {
+	if s.spool == nil || s.spool.Len() == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.conf.Spool.ReplayInterval.Duration)
+	err := s.Health(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+
+	// New batches are spooled behind these while there are any left, so no lock is needed for the order
+	replayed := 0
+	for {
+		seq, batch, ok, err := s.spool.Oldest()
+		if !ok {
+			break
+		}
+		if err != nil {
+			// We can't read it back, don't let it hold up the rest
+			log.Println(err)
+		} else {
+			err = s.out.write(context.Background(), batch)
+			if err != nil && !rejected(err) {
+				log.Println(err)
+				log.Printf("Error while replaying the InfluxDB spool, %d batches left\n", s.spool.Len())
+				return
+			}
+			points := countLines([]byte(batch))
+			if err != nil {
+				// It's never going to be accepted either
+				log.Println(err)
+				atomic.AddUint64(&s.dropped, uint64(points))
+			} else {
+				atomic.AddUint64(&s.written, uint64(points))
+			}
+		}
+		err = s.spool.Remove(seq)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		log.Printf("Replayed %d spooled InfluxDB batches\n", replayed)
+	}
+}
+
+// The points themselves were refused, writing them again won't help
+func rejected(err error) bool {
+	var status int
+	var herr *http2.Error
+	var werr *writeError
+	switch {
+	case errors.As(err, &herr):
+		status = herr.StatusCode
+	case errors.As(err, &werr):
+		status = werr.StatusCode
+	}
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// One line with its trailing newline, timestamps are in the given precision
+func lineProtocol(sample sink.Sample, naming *sink.Naming, precision time.Duration) string {
+	tags, fields := naming.Flatten(sample)
+	p := influxdb2.NewPoint(naming.Measurement(sample.Measurement), tags, fields, sample.Time)
+	return write.PointToLineProtocol(p, precision)
+}
+
+// v2 writes to a bucket with the InfluxDB 2 client
+type v2 struct {
+	client   influxdb2.Client
+	writeAPI api.WriteAPIBlocking
+}
+
+func newV2(conf config.InfluxDB, precision time.Duration) *v2 {
+	client := influxdb2.NewClientWithOptions(conf.Server, conf.Token, influxdb2.DefaultOptions().SetPrecision(precision))
+	return &v2{client: client, writeAPI: client.WriteAPIBlocking(conf.Org, conf.Bucket)}
+}
+
+func (w *v2) write(ctx context.Context, batch string) error {
+	return w.writeAPI.WriteRecord(ctx, batch)
+}
+
+func (w *v2) health(ctx context.Context) error {
+	health, err := w.client.Health(ctx)
+	if err != nil {
+		return err
+	}
+	if health.Status != domain.HealthCheckStatusPass {
+		if health.Message != nil {
+			return errors.New(*health.Message)
+		}
+		return fmt.Errorf("health check status %s", health.Status)
+	}
+	return nil
+}
+
+func (w *v2) close() {
+	w.client.Close()
+}
@@ -0,0 +1,194 @@
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+spool is a write-ahead directory of line protocol batches that couldn't be
+written. Each batch is a segment file named by its sequence number so they are
+replayed in the order they failed, across restarts too. When the directory
+would grow past maxSize the oldest segments are dropped to make room.
+*/
+type spool struct {
+	mu       sync.Mutex
+	dir      string
+	maxSize  int64
+	segments []segment // oldest first
+	size     int64
+	next     uint64
+	dropped  uint64 // points thrown away to stay under maxSize
+}
+
+type segment struct {
+	seq    uint64
+	size   int64
+	points int
+}
+
+const segmentExt = ".lp"
+
+// Open the spool directory and pick up any segments left from the last run
+func openSpool(dir string, maxSize int64) (*spool, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spool{dir: dir, maxSize: maxSize}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// A batch we were still writing when we stopped
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, segment{seq: seq, size: int64(len(data)), points: countLines(data)})
+		s.size += int64(len(data))
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	if len(s.segments) > 0 {
+		s.next = s.segments[len(s.segments)-1].seq + 1
+	}
+	return s, nil
+}
+
+// Append spools a batch, making room by dropping the oldest segments
+func (s *spool) Append(batch string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	points := countLines([]byte(batch))
+	size := int64(len(batch))
+	if size > s.maxSize {
+		s.dropped += uint64(points)
+		return fmt.Errorf("batch of %d bytes is bigger than the whole spool, dropped %d points", size, points)
+	}
+	for s.size+size > s.maxSize && len(s.segments) > 0 {
+		oldest := s.segments[0]
+		err := os.Remove(s.path(oldest.seq))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.segments = s.segments[1:]
+		s.size -= oldest.size
+		s.dropped += uint64(oldest.points)
+	}
+
+	// Write it out under a temporary name so a crash never leaves half a segment
+	seq := s.next
+	tmp := s.path(seq) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(batch)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path(seq))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.next++
+	s.segments = append(s.segments, segment{seq: seq, size: size, points: points})
+	s.size += size
+	return nil
+}
+
+// Oldest returns the oldest spooled batch and its sequence number, ok is false when the spool is empty
+func (s *spool) Oldest() (uint64, string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 {
+		return 0, "", false, nil
+	}
+	seq := s.segments[0].seq
+	data, err := os.ReadFile(s.path(seq))
+	if err != nil {
+		return seq, "", true, err
+	}
+	return seq, string(data), true, nil
+}
+
+// Remove drops a segment once it has been replayed
+func (s *spool) Remove(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, seg := range s.segments {
+		if seg.seq != seq {
+			continue
+		}
+		err := os.Remove(s.path(seq))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+		s.size -= seg.size
+		return nil
+	}
+	return nil
+}
+
+// Len is the number of batches waiting to be replayed
+func (s *spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments)
+}
+
+func (s *spool) Stats() map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var points int
+	for _, seg := range s.segments {
+		points += seg.points
+	}
+	return map[string]float64{
+		"spool_batches":              float64(len(s.segments)),
+		"spool_points":               float64(points),
+		"spool_bytes":                float64(s.size),
+		"spool_dropped_points_total": float64(s.dropped),
+	}
+}
+
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+func countLines(data []byte) int {
+	lines := bytes.Count(data, []byte("\n"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
@@ -0,0 +1,201 @@
+package influx
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A batch of n points, each line tagged with the batch so we can tell them apart
+func batch(name string, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString("m,batch=" + name + " v=1\n")
+	}
+	return b.String()
+}
+
+// Drain the spool oldest first like replay does
+func drain(t *testing.T, s *spool) []string {
+	t.Helper()
+	var batches []string
+	for {
+		seq, data, ok, err := s.Oldest()
+		if !ok {
+			return batches
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, data)
+		if err := s.Remove(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		appends []string
+		want    []string // what's left, oldest first
+		dropped float64
+	}{
+		{
+			name:    "replayed in order",
+			maxSize: 1 << 20,
+			appends: []string{batch("a", 2), batch("b", 1), batch("c", 3)},
+			want:    []string{batch("a", 2), batch("b", 1), batch("c", 3)},
+		},
+		{
+			name:    "oldest dropped to stay under the cap",
+			maxSize: int64(len(batch("a", 2)) * 2),
+			appends: []string{batch("a", 2), batch("b", 2), batch("c", 2)},
+			want:    []string{batch("b", 2), batch("c", 2)},
+			dropped: 2,
+		},
+		{
+			name:    "several dropped to fit a big one",
+			maxSize: int64(len(batch("a", 3))),
+			appends: []string{batch("a", 1), batch("b", 1), batch("c", 3)},
+			want:    []string{batch("c", 3)},
+			dropped: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := openSpool(t.TempDir(), tt.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range tt.appends {
+				if err := s.Append(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := s.Stats()["spool_dropped_points_total"]; got != tt.dropped {
+				t.Errorf("dropped %g points, want %g", got, tt.dropped)
+			}
+			if got := s.Stats()["spool_batches"]; got != float64(len(tt.want)) {
+				t.Errorf("%g batches spooled, want %d", got, len(tt.want))
+			}
+
+			got := drain(t, s)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("replayed %q, want %q", got, tt.want)
+			}
+			if s.Len() != 0 || s.Stats()["spool_bytes"] != 0 {
+				t.Errorf("spool not empty after replaying everything: %v", s.Stats())
+			}
+		})
+	}
+}
+
+func TestSpoolBatchBiggerThanSpool(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(batch("a", 3)); err == nil {
+		t.Error("a batch bigger than the whole spool was spooled")
+	}
+	if got := s.Stats()["spool_dropped_points_total"]; got != 3 {
+		t.Errorf("dropped %g points, want 3", got)
+	}
+	if s.Len() != 0 {
+		t.Errorf("%d batches spooled, want none", s.Len())
+	}
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{batch("a", 1), batch("b", 2), batch("c", 3)} {
+		if err := s.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a was replayed before we stopped, and we were halfway through spooling another
+	seq, _, _, _ := s.Oldest()
+	if err := s.Remove(seq); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000099.lp.tmp"), []byte("half"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Not ours, left alone
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := s.Stats()
+	if stats["spool_batches"] != 2 || stats["spool_points"] != 5 {
+		t.Errorf("picked up %v, want 2 batches of 5 points", stats)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000099.lp.tmp")); !os.IsNotExist(err) {
+		t.Error("the half written segment wasn't cleaned up")
+	}
+
+	// New batches go after the ones from the last run
+	if err := s.Append(batch("d", 1)); err != nil {
+		t.Fatal(err)
+	}
+	got := drain(t, s)
+	want := []string{batch("b", 2), batch("c", 3), batch("d", 1)}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestSpoolEvictionAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	size := int64(len(batch("a", 1)))
+	s, err := openSpool(dir, size*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Append(batch("a", 1))
+	s.Append(batch("b", 1))
+
+	// The size of what's already on disk counts towards the cap
+	s, err = openSpool(dir, size*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(batch("c", 1)); err != nil {
+		t.Fatal(err)
+	}
+	got := drain(t, s)
+	want := []string{batch("b", 1), batch("c", 1)}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestCountLines(t *testing.T) {
+	tests := []struct {
+		data string
+		want int
+	}{
+		{"", 0},
+		{"m v=1\n", 1},
+		{"m v=1", 1},
+		{"m v=1\nm v=2\n", 2},
+		{"m v=1\nm v=2", 2},
+	}
+	for _, tt := range tests {
+		if got := countLines([]byte(tt.data)); got != tt.want {
+			t.Errorf("countLines(%q) = %d, want %d", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package influx
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+	"github.com/cheetahfox/openstack-instance-stats/sink"
+)
+
+/*
+UDPSink sends line protocol to an InfluxDB 1.x UDP listener. It's fire and
+forget, there's no way to know whether anything arrived so nothing is retried
+or spooled. Lines are packed into datagrams of up to payload_size bytes, a
+line that's bigger than that is sent by itself.
+*/
+type UDPSink struct {
+	conn        net.Conn
+	payloadSize int
+	naming      *sink.Naming
+	precision   time.Duration
+	sent        uint64
+	dropped     uint64
+}
+
+func NewUDP(conf config.InfluxDBUDP, naming *sink.Naming) (*UDPSink, error) {
+	conn, err := net.Dial("udp", conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPSink{
+		conn:        conn,
+		payloadSize: conf.PayloadSize,
+		naming:      naming,
+		precision:   config.Precisions[conf.Precision],
+	}, nil
+}
+
+func (u *UDPSink) Name() string {
+	return "influxdb-udp"
+}
+
+func (u *UDPSink) Write(samples []sink.Sample) error {
+	var packet strings.Builder
+	var lines int
+	var lastErr error
+
+	send := func() {
+		if lines == 0 {
+			return
+		}
+		_, err := u.conn.Write([]byte(packet.String()))
+		if err != nil {
+			atomic.AddUint64(&u.dropped, uint64(lines))
+			lastErr = err
+		} else {
+			atomic.AddUint64(&u.sent, uint64(lines))
+		}
+		packet.Reset()
+		lines = 0
+	}
+
+	for _, sample := range samples {
+		line := lineProtocol(sample, u.naming, u.precision)
+		if packet.Len()+len(line) > u.payloadSize {
+			send()
+		}
+		packet.WriteString(line)
+		lines++
+	}
+	send()
+	return lastErr
+}
+
+func (u *UDPSink) Stats() map[string]float64 {
+	return map[string]float64{
+		"written_points_total": float64(atomic.LoadUint64(&u.sent)),
+		"dropped_points_total": float64(atomic.LoadUint64(&u.dropped)),
+	}
+}
+
+func (u *UDPSink) Close() error {
+	return u.conn.Close()
+}
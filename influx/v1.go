@@ -0,0 +1,118 @@
+package influx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+)
+
+// Same as the InfluxDB 2 client's default
+const v1Timeout = 20 * time.Second
+
+/*
+v1 writes to an InfluxDB 1.x database and retention policy through the /write
+endpoint, which 2.x also still serves for compatibility.
+*/
+type v1 struct {
+	writeURL string
+	pingURL  string
+	username string
+	password string
+	client   *http.Client
+}
+
+// The 1.x api spells microseconds as u
+var v1Precisions = map[string]string{
+	"ns": "ns",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
+
+// writeError is a write the 1.x api answered with an error status
+type writeError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *writeError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func newV1(conf config.InfluxDB) (*v1, error) {
+	server, err := url.Parse(strings.TrimSuffix(conf.Server, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("db", conf.Database)
+	query.Set("precision", v1Precisions[conf.Precision])
+	if conf.RetentionPolicy != "" {
+		query.Set("rp", conf.RetentionPolicy)
+	}
+	if conf.Consistency != "" {
+		query.Set("consistency", conf.Consistency)
+	}
+
+	write := *server
+	write.Path += "/write"
+	write.RawQuery = query.Encode()
+	ping := *server
+	ping.Path += "/ping"
+
+	return &v1{
+		writeURL: write.String(),
+		pingURL:  ping.String(),
+		username: conf.Username,
+		password: conf.Password,
+		client:   &http.Client{Timeout: v1Timeout},
+	}, nil
+}
+
+func (w *v1) write(ctx context.Context, batch string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.writeURL, strings.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return w.do(req)
+}
+
+func (w *v1) health(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.pingURL, nil)
+	if err != nil {
+		return err
+	}
+	return w.do(req)
+}
+
+func (w *v1) close() {
+	w.client.CloseIdleConnections()
+}
+
+// Both /write and /ping answer 204 when all is well
+func (w *v1) do(req *http.Request) error {
+	if w.username != "" {
+		req.SetBasicAuth(w.username, w.password)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	// The error comes back as {"error":"..."}, it's readable enough as is
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &writeError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
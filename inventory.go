@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cheetahfox/openstack-instance-stats/metrics"
+	"github.com/cheetahfox/openstack-instance-stats/sink"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedstatus"
+)
+
+// Nova's status for deleted servers, and what we give instances that are no longer listed
+const deletedStatus = "DELETED"
+
+/*
+inventoryStats writes every instance we listed, whatever its status, to the
+"OpenStack inventory" measurement with its power and task state and age, and
+how many instances each project has in each status to "OpenStack instance
+counts". Instances that changed status since the last pass get a point in
+"OpenStack events". Only called by inventoryWorker, which owns c.last.
+*/
+func inventoryStats(c *collector, instances []metrics.Vms, out sink.Sink, stamp time.Time) error {
+	b := sink.NewBatch(stamp)
+
+	type projectStatus struct {
+		project, name, domain, status string
+	}
+	counts := make(map[projectStatus]float64)
+
+	current := make(map[string]metrics.Vms, len(instances))
+	for _, s := range instances {
+		current[s.UUID] = s
+
+		tags := map[string]string{
+			"Status":      s.Status,
+			"Power State": extendedstatus.PowerState(s.PowerState).String(),
+		}
+		if s.TaskState != "" {
+			tags["Task State"] = s.TaskState
+		}
+		fields := map[string]float64{
+			"power_state_code": float64(s.PowerState),
+			"active":           boolFloat(s.Status == "ACTIVE"),
+		}
+		if !s.Created.IsZero() {
+			fields["age_seconds"] = b.Time.Sub(s.Created).Seconds()
+		}
+		b.InstanceFields(s, "OpenStack inventory", tags, fields)
+
+		counts[projectStatus{s.ProjectID, s.ProjectName, s.DomainName, s.Status}]++
+
+		if prev, found := c.last[s.UUID]; found && prev.Status != s.Status {
+			statusEvent(b, s, prev.Status)
+		}
+	}
+
+	// The first pass only sets the baseline
+	if c.last != nil {
+		var gone []string
+		for uuid := range c.last {
+			if _, found := current[uuid]; !found {
+				gone = append(gone, uuid)
+			}
+		}
+		sort.Strings(gone)
+		for _, uuid := range gone {
+			prev := c.last[uuid]
+			s := prev
+			s.Status = deletedStatus
+			statusEvent(b, s, prev.Status)
+		}
+	}
+	c.last = current
+
+	for k, n := range counts {
+		tags := map[string]string{
+			"Project": k.project,
+			"Status":  k.status,
+			"cloud":   c.name,
+		}
+		if c.conf.Region != "" {
+			tags["region"] = c.conf.Region
+		}
+		if k.name != "" {
+			tags["Project Name"] = k.name
+		}
+		if k.domain != "" {
+			tags["Domain Name"] = k.domain
+		}
+		b.Fields("OpenStack instance counts", tags, map[string]float64{"instances": n})
+	}
+
+	return out.Write(b.Samples)
+}
+
+// An instance went from one status to another, ACTIVE to ERROR for example
+func statusEvent(b *sink.Batch, s metrics.Vms, previous string) {
+	b.TaggedPoint(s, "OpenStack events", map[string]string{
+		"Event":           "status_change",
+		"Previous Status": previous,
+		"Status":          s.Status,
+	}, "status_change", 1)
+}
@@ -0,0 +1,126 @@
+package keystone
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/domains"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+)
+
+/*
+Projects resolves project ids to project and domain names with Keystone v3 and
+caches them for ttl. With admin credentials we list every project and domain in
+one go, otherwise we fall back to looking up each project by itself. When we
+aren't allowed to see a project or domain at all the name is left empty and
+only the id gets used.
+*/
+type Projects struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	projects map[string]entry
+	domains  map[string]entry
+	listed   time.Time // last time we tried to list everything
+}
+
+type entry struct {
+	name     string
+	domainID string
+	expires  time.Time
+}
+
+func NewProjects(ttl time.Duration) *Projects {
+	return &Projects{
+		ttl:      ttl,
+		projects: make(map[string]entry),
+		domains:  make(map[string]entry),
+	}
+}
+
+// Lookup returns the project and domain names for a project id, client is a Keystone v3 client.
+func (p *Projects) Lookup(client *gophercloud.ServiceClient, id string) (string, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	proj, found := p.projects[id]
+	if found && now.Before(proj.expires) {
+		return proj.name, p.domains[proj.domainID].name, nil
+	}
+
+	// Try to refresh everything at once, at most once per ttl
+	if now.Sub(p.listed) > p.ttl {
+		p.listed = now
+		err := p.listAll(client, now)
+		if err != nil && !forbidden(err) {
+			return "", "", err
+		}
+		proj, found = p.projects[id]
+	}
+
+	if !found || !now.Before(proj.expires) {
+		proj = entry{expires: now.Add(p.ttl)}
+		project, err := projects.Get(client, id).Extract()
+		if err != nil && !forbidden(err) {
+			return "", "", err
+		}
+		if err == nil {
+			proj.name = project.Name
+			proj.domainID = project.DomainID
+		}
+		p.projects[id] = proj
+	}
+
+	dom, found := p.domains[proj.domainID]
+	if proj.domainID != "" && (!found || !now.Before(dom.expires)) {
+		dom = entry{expires: now.Add(p.ttl)}
+		domain, err := domains.Get(client, proj.domainID).Extract()
+		if err != nil && !forbidden(err) {
+			return proj.name, "", err
+		}
+		if err == nil {
+			dom.name = domain.Name
+		}
+		p.domains[proj.domainID] = dom
+	}
+
+	return proj.name, dom.name, nil
+}
+
+// Needs to be called holding the lock
+func (p *Projects) listAll(client *gophercloud.ServiceClient, now time.Time) error {
+	allPages, err := projects.List(client, projects.ListOpts{}).AllPages()
+	if err != nil {
+		return err
+	}
+	allProjects, err := projects.ExtractProjects(allPages)
+	if err != nil {
+		return err
+	}
+	for _, project := range allProjects {
+		p.projects[project.ID] = entry{name: project.Name, domainID: project.DomainID, expires: now.Add(p.ttl)}
+	}
+
+	allPages, err = domains.List(client, domains.ListOpts{}).AllPages()
+	if err != nil {
+		return err
+	}
+	allDomains, err := domains.ExtractDomains(allPages)
+	if err != nil {
+		return err
+	}
+	for _, domain := range allDomains {
+		p.domains[domain.ID] = entry{name: domain.Name, expires: now.Add(p.ttl)}
+	}
+	return nil
+}
+
+// Project scoped credentials usually can't list or see other projects
+func forbidden(err error) bool {
+	switch err.(type) {
+	case gophercloud.ErrDefault403, gophercloud.ErrDefault404:
+		return true
+	}
+	return false
+}
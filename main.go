@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,59 +10,110 @@ import (
 	"os/signal"
 	"reflect"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	influx "github.com/cheetahfox/openstack-instance-stats/influx"
-	"github.com/cheetahfox/openstack-instance-stats/handlers"
 	config "github.com/cheetahfox/openstack-instance-stats/config"
+	"github.com/cheetahfox/openstack-instance-stats/filter"
+	"github.com/cheetahfox/openstack-instance-stats/handlers"
+	influx "github.com/cheetahfox/openstack-instance-stats/influx"
 	"github.com/cheetahfox/openstack-instance-stats/metrics"
+	"github.com/cheetahfox/openstack-instance-stats/otlp"
+	"github.com/cheetahfox/openstack-instance-stats/prometheus"
+	"github.com/cheetahfox/openstack-instance-stats/sink"
+	"github.com/cheetahfox/openstack-instance-stats/tagging"
 	"github.com/gophercloud/gophercloud"
-	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/apiversions"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/availabilityzones"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/diagnostics"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedserverattributes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/extendedstatus"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/hypervisors"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/flavors"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api"
-	"github.com/influxdata/influxdb-client-go/v2/domain"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
 )
 
-// Fill the server list for the first time
-func populateServers(provider *gophercloud.ProviderClient, conf config.Sysconfig) ([]metrics.Vms, error) {
-	var osServers []metrics.Vms
+// Servers as they're listed, the hypervisor attributes are only there for admins
+type listedServer struct {
+	servers.Server
+	extendedserverattributes.ServerAttributesExt
+	availabilityzones.ServerAvailabilityZoneExt
+	extendedstatus.ServerExtendedStatusExt
+}
 
-	endpoint := gophercloud.EndpointOpts{Region: os.Getenv("OS_REGION_NAME")}
-	client, err := openstack.NewComputeV2(provider, endpoint)
-	if err != nil {
-		return nil, err
-	}
+// Nova can be a little behind our clock, changes-since goes back this much further
+const changesSinceOverlap = time.Minute
 
+/*
+Fill the server list for the first time, and keep it up to date after that.
+The whole list is only fetched every collection.full_resync_interval, in
+between we only ask Nova for the servers that changed since the last listing
+(changes-since), which includes the ones that were deleted.
+*/
+func populateServers(c *collector, svc *services, conf config.Sysconfig) ([]metrics.Vms, error) {
 	listOpts := servers.ListOpts{
 		AllTenants: false,
 		Name:       "",
 	}
 	// If we are doing a site wide scan
-	if conf.Scope == "site" {
+	if c.conf.Scope == "site" {
 		listOpts.AllTenants = true
 	}
 
-	allPages, err := servers.List(client, listOpts).AllPages()
+	now := time.Now()
+	resync := conf.Collection.FullResync.Duration
+	full := c.inventory == nil || resync == 0 || now.Sub(c.resynced) >= resync
+	if full {
+		// Server tags are there from 2.26, which we only get when we can use 2.48
+		c.filter.ListOpts(&listOpts, svc.compute.Microversion != "")
+	} else {
+		/*
+			The filters aren't pushed down here, a server that changed so it no
+			longer matches them wouldn't be listed and we'd never drop it. Match
+			sorts them out below.
+		*/
+		listOpts.ChangesSince = c.synced.Add(-changesSinceOverlap).UTC().Format(time.RFC3339)
+	}
+
+	allPages, err := servers.List(svc.compute, listOpts).AllPages()
 	if err != nil {
 		return nil, err
 	}
-	allServers, err := servers.ExtractServers(allPages)
+	var allServers []listedServer
+	err = servers.ExtractServersInto(allPages, &allServers)
 	if err != nil {
 		return nil, err
 	}
 
-	var s metrics.Vms
-
+	if full {
+		c.inventory = make(map[string]metrics.Vms, len(allServers))
+		c.resynced = now
+	}
+	c.synced = now
 	for _, server := range allServers {
-		s.UUID = server.ID
-		s.Name = server.Name
-		s.ProjectID = server.TenantID
-		s.Status = server.Status
+		if server.Status == deletedStatus {
+			delete(c.inventory, server.ID)
+			continue
+		}
+		s, ok := newInstance(c, svc, conf, server)
+		if !ok {
+			// It may have matched the filters before it changed
+			delete(c.inventory, server.ID)
+			continue
+		}
+		c.inventory[server.ID] = s
+	}
+
+	osServers := make([]metrics.Vms, 0, len(c.inventory))
+	for _, s := range c.inventory {
+		c.tagger.Seen(s.Tags)
 		osServers = append(osServers, s)
 	}
+	sort.Slice(osServers, func(i, j int) bool { return osServers[i].UUID < osServers[j].UUID })
 
 	/*
 		found := fmt.Sprintf("Found %d OpenStack instances", len(osServers))
@@ -70,17 +122,130 @@ func populateServers(provider *gophercloud.ProviderClient, conf config.Sysconfig
 	return osServers, nil
 }
 
+// Everything we know about a server, ok is false when the filters drop it
+func newInstance(c *collector, svc *services, conf config.Sysconfig, server listedServer) (metrics.Vms, bool) {
+	var projectName, domainName string
+	var err error
+	if svc.identity != nil {
+		projectName, domainName, err = c.projects.Lookup(svc.identity, server.TenantID)
+		if err != nil {
+			log.Println(err)
+			log.Printf("Error while looking up project %s\n", server.TenantID)
+		}
+	}
+	instance := filter.Instance{
+		ProjectID:        server.TenantID,
+		ProjectName:      projectName,
+		Name:             server.Name,
+		Metadata:         server.Metadata,
+		AvailabilityZone: server.AvailabilityZone,
+	}
+	if server.Tags != nil {
+		instance.Tags = *server.Tags
+	}
+	if !c.filter.Match(instance) {
+		return metrics.Vms{}, false
+	}
+
+	var s metrics.Vms
+	s.UUID = server.ID
+	s.Cloud = c.name
+	s.Region = c.conf.Region
+	s.Hypervisor = server.HypervisorHostname
+	s.Name = server.Name
+	s.ProjectID = server.TenantID
+	s.ProjectName = projectName
+	s.DomainName = domainName
+	s.Status = server.Status
+	s.PowerState = int(server.PowerState)
+	s.TaskState = server.TaskState
+	s.Created = server.Created
+	s.Updated = server.Updated
+	s.Tags = c.tagger.Tags(server.Metadata, instance.Tags)
+	s.Addresses = metrics.ParseAddresses(server.Addresses)
+	s.IP = metrics.PrimaryAddress(s.Addresses, primaryNetwork, conf.Collection.PrimaryAddress == "floating")
+	s.FloatingIP = metrics.FloatingIP(s.Addresses, s.IP)
+	s.Flavor, err = serverFlavor(svc.compute, server.Flavor)
+	if err != nil {
+		log.Println(err)
+		log.Printf("Error while looking up the flavor of %s\n", server.ID)
+	}
+	return s, true
+}
+
+// Flavors we've already looked up, keyed by compute endpoint and flavor id
+var flavorCache = struct {
+	sync.Mutex
+	flavors map[string]metrics.Flavor
+}{flavors: make(map[string]metrics.Flavor)}
+
 /*
-Get the Nova API Diagnostics for a specific Instance ID
+Work out the flavor of a server. From microversion 2.47 the flavor details are
+embedded in the server, before that we only get the flavor id and have to look
+it up with the flavors API.
 */
-func serverStats(provider *gophercloud.ProviderClient, serverId string) (map[string]interface{}, error) {
-	endpoint := gophercloud.EndpointOpts{Region: os.Getenv("OS_REGION_NAME")}
-	client, err := openstack.NewComputeV2(provider, endpoint)
+func serverFlavor(client *gophercloud.ServiceClient, embedded map[string]interface{}) (metrics.Flavor, error) {
+	if name, ok := embedded["original_name"].(string); ok {
+		flavor := metrics.Flavor{Name: name}
+		if v, err := getFloat(embedded["vcpus"]); err == nil {
+			flavor.VCPUs = int(v)
+		}
+		if v, err := getFloat(embedded["ram"]); err == nil {
+			flavor.RAM = int(v)
+		}
+		if v, err := getFloat(embedded["disk"]); err == nil {
+			flavor.Disk = int(v)
+		}
+		return flavor, nil
+	}
+
+	id, ok := embedded["id"].(string)
+	if !ok {
+		return metrics.Flavor{}, nil
+	}
+
+	key := client.Endpoint + id
+	flavorCache.Lock()
+	flavor, found := flavorCache.flavors[key]
+	flavorCache.Unlock()
+	if found {
+		return flavor, nil
+	}
+
+	f, err := flavors.Get(client, id).Extract()
 	if err != nil {
-		return nil, err
+		if _, notFound := err.(gophercloud.ErrDefault404); !notFound {
+			return metrics.Flavor{ID: id}, err
+		}
+		// The flavor has been deleted, remember that so we don't keep asking
+		flavor = metrics.Flavor{ID: id, Name: id}
+	} else {
+		flavor = metrics.Flavor{ID: f.ID, Name: f.Name, VCPUs: f.VCPUs, RAM: f.RAM, Disk: f.Disk}
 	}
 
-	diags, err := diagnostics.Get(client, serverId).Extract()
+	flavorCache.Lock()
+	flavorCache.flavors[key] = flavor
+	flavorCache.Unlock()
+	return flavor, nil
+}
+
+/*
+Get the Nova API Diagnostics for a specific Instance ID
+When Nova supports microversion 2.48 we get the standardized diagnostics and
+flatten them into the same keys the older format uses.
+*/
+func serverStats(client *gophercloud.ServiceClient, serverId string) (map[string]interface{}, error) {
+	result := diagnostics.Get(client, serverId)
+	if client.Microversion == standardDiagnostics {
+		var diags metrics.Diagnostics
+		err := result.ExtractInto(&diags)
+		if err != nil {
+			return nil, err
+		}
+		return diags.Flatten(), nil
+	}
+
+	diags, err := result.Extract()
 	if err != nil {
 		return nil, err
 	}
@@ -88,133 +253,688 @@ func serverStats(provider *gophercloud.ProviderClient, serverId string) (map[str
 	return diags, nil
 }
 
+// First Nova microversion with the standardized diagnostics format
+const standardDiagnostics = "2.48"
+
+/*
+Work out which microversion to talk to Nova with. If the compute API supports
+2.48 or newer we use 2.48 (standardized diagnostics and embedded flavors),
+otherwise we leave it empty and get the legacy formats.
+This is only asked when the compute client gets built.
+*/
+func novaMicroversion(client *gophercloud.ServiceClient) (string, error) {
+	version, err := apiversions.Get(client, "v2.1").Extract()
+	if err != nil {
+		return "", err
+	}
+
+	microversion := ""
+	if compareMicroversion(version.Version, standardDiagnostics) >= 0 {
+		microversion = standardDiagnostics
+	}
+
+	return microversion, nil
+}
+
+// Compare two "major.minor" microversion strings, returns -1, 0 or 1
+func compareMicroversion(a, b string) int {
+	var aMajor, aMinor, bMajor, bMinor int
+	// An empty or malformed version (no microversions at all) sorts first
+	fmt.Sscanf(a, "%d.%d", &aMajor, &aMinor)
+	fmt.Sscanf(b, "%d.%d", &bMajor, &bMinor)
+
+	if aMajor != bMajor {
+		if aMajor < bMajor {
+			return -1
+		}
+		return 1
+	}
+	if aMinor != bMinor {
+		if aMinor < bMinor {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
 /*
 statsWorker is the main data collection loop.
-We get a list of current Vms running and then call nova diags API to get detailed
-stats about each vm.
+We take the list of current Vms from inventoryWorker and then call nova diags API
+to get detailed stats about each vm. Each pass has to finish before the next one
+is due, anything still outstanding when the deadline hits is cut off.
 */
-func statsWorker(conf config.Sysconfig, osProvider *gophercloud.ProviderClient, dbapi api.WriteAPI) {
-	ticker := time.NewTicker(time.Second * time.Duration(conf.RefreshTime))
-	for range ticker.C {
-		// It's only one more api call to refresh the instances every time through
-		instances, err := populateServers(osProvider, conf)
+func statsWorker(ctx context.Context, conf config.Sysconfig, c *collector, out sink.Sink, prom *prometheus.Prometheus) {
+	interval := conf.Collection.RefreshInterval.Duration
+	schedule(ctx, interval, conf.Collection.Jitter.Duration, conf.Collection.Align, func(stamp, deadline time.Time) {
+		// At the deadline no more requests are sent and the ones still going are cancelled
+		ctx, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+
+		instances, portIdx, listed := c.instances()
+		if !listed {
+			// Nothing to do until the servers have been listed once
+			return
+		}
+		svc, err := c.services(ctx, interval)
 		if err != nil {
 			log.Println(err)
-			log.Println("Error while populating server list")
-		}
-		for _, s := range instances {
-			// Only get stats from Active instances.
-			if s.Status == "ACTIVE" {
-				stats, err := serverStats(osProvider, s.UUID)
-				if err != nil {
-					log.Println(err)
-					fmt.Println("Error while getting Server stats")
-				}
-				// Loop through the stats and write a point for each metric
-				for k, v := range stats {
-					val, err := getFloat(v)
-					if err == nil {
-						influx.WritePoint(s, "OpenStack Metrics", k, val, dbapi)
-					}
-				}
-
-				// Generated metrics
-				err = cpuStats(s, stats, dbapi)
-				if err != nil {
-					log.Println(err)
-				}
-				err = ioStats(s, stats, dbapi)
-				if err != nil {
-					log.Println(err)
-				}
+			log.Printf("Error while setting up the service clients for %s\n", c)
+			return
+		}
+
+		collectStats(ctx, conf, c, svc, out, prom, instances, portIdx, stamp)
+		if ctx.Err() != nil {
+			// Don't sweep after a partial pass (or one cut short by shutting down), we would drop instances we just didn't get to
+			log.Printf("Collection pass for %s didn't finish within %s\n", c, interval)
+		} else {
+			// Drop the series and counters of anything we didn't see this time through
+			prom.Sweep(c.name, c.conf.Region)
+			c.rates.Sweep()
+		}
+	})
+}
+
+/*
+inventoryWorker keeps the server list statsWorker works from up to date every
+collection.inventory_interval, and writes the inventory while it's at it. The
+first listing is done straight away so the diagnostics don't wait on it.
+*/
+func inventoryWorker(ctx context.Context, conf config.Sysconfig, c *collector, out sink.Sink) {
+	interval := conf.Collection.InventoryInterval.Duration
+	inventory(ctx, conf, c, out, stampTime(interval, conf.Collection.Align))
+	schedule(ctx, interval, conf.Collection.Jitter.Duration, conf.Collection.Align, func(stamp, _ time.Time) {
+		inventory(ctx, conf, c, out, stamp)
+	})
+}
+
+func inventory(ctx context.Context, conf config.Sysconfig, c *collector, out sink.Sink, stamp time.Time) {
+	svc, err := c.services(ctx, conf.Collection.InventoryInterval.Duration)
+	if err != nil {
+		log.Println(err)
+		log.Printf("Error while setting up the service clients for %s\n", c)
+		c.listFailed(err)
+		return
+	}
+
+	instances, err := populateServers(c, svc, conf)
+	if err != nil {
+		log.Println(err)
+		log.Printf("Error while populating server list for %s\n", c)
+		c.listFailed(err)
+		return
+	}
+
+	// Every instance whatever its status, the diagnostics are only for the active ones
+	err = inventoryStats(c, instances, out, stamp)
+	if err != nil {
+		log.Println(err)
+		log.Printf("Error while writing the inventory of %s\n", c)
+	}
+
+	// Used to tag the network stats, we can live without it
+	portIdx, err := neutronPorts(c, svc.network, instances)
+	if err != nil {
+		log.Println(err)
+		log.Printf("Error while listing Neutron ports for %s\n", c)
+	}
+
+	c.setInstances(instances, portIdx)
+}
+
+/*
+Fan the active instances out to a pool of collection.workers workers, optionally
+limited to collection.rate_limit diagnostics requests per second to go easy on Nova.
+*/
+func collectStats(ctx context.Context, conf config.Sysconfig, c *collector, svc *services, out sink.Sink, prom *prometheus.Prometheus, instances []metrics.Vms, portIdx portIndex, stamp time.Time) {
+	jobs := make(chan metrics.Vms)
+	var wg sync.WaitGroup
+
+	for i := 0; i < conf.Collection.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				instanceStats(conf, c, svc, s, out, prom, portIdx, stamp)
+			}
+		}()
+	}
+
+	var limit <-chan time.Time
+	if conf.Collection.RateLimit > 0 {
+		every := time.Duration(float64(time.Second) / conf.Collection.RateLimit)
+		// Past a billion a second it rounds down to nothing, which NewTicker won't take
+		if every < 1 {
+			every = 1
+		}
+		limiter := time.NewTicker(every)
+		defer limiter.Stop()
+		limit = limiter.C
+	}
+
+dispatch:
+	for _, s := range instances {
+		// Only get stats from Active instances.
+		if s.Status != "ACTIVE" {
+			continue
+		}
+		if limit != nil {
+			select {
+			case <-limit:
+			case <-ctx.Done():
+				break dispatch
 			}
 		}
+		select {
+		case jobs <- s:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// Get the diagnostics for a single instance and write out everything we get
+func instanceStats(conf config.Sysconfig, c *collector, svc *services, s metrics.Vms, out sink.Sink, prom *prometheus.Prometheus, portIdx portIndex, stamp time.Time) {
+	stats, err := serverStats(svc.compute, s.UUID)
+	if err != nil {
+		log.Println(err)
+		fmt.Println("Error while getting Server stats")
+		return
+	}
+	// The rates go by when we actually got the counters, not the time the points are stamped with
+	fetched := time.Now()
+	// Everything for this instance is handed to the outputs in one go
+	b := sink.NewBatch(stamp)
+	// Everything we write for this instance also goes to prometheus
+	values := make(map[string]float64)
+
+	// Loop through the stats and write a point for each metric
+	for k, v := range stats {
+		val, err := getFloat(v)
+		if err == nil {
+			b.Point(s, "OpenStack Metrics", k, val)
+			values[k] = val
+		}
+	}
+
+	// Generated metrics
+	cpuTotal, err := cpuStats(s, stats, b)
+	if err != nil {
+		log.Println(err)
+	} else {
+		values["cpu_total"] = cpuTotal
+	}
+	ioTotals, err := ioStats(s, stats, conf.Collection.DiskDevices, b)
+	if err != nil {
+		log.Println(err)
+	}
+	for k, v := range ioTotals {
+		values[k] = v
+	}
+	for k, v := range memStats(s, stats, b) {
+		values[k] = v
+	}
+	netTotals, err := netStats(s, stats, portIdx, b)
+	if err != nil {
+		log.Println(err)
+	}
+	for k, v := range netTotals {
+		values[k] = v
+	}
+
+	for k, v := range rateStats(c.rates, s, values, fetched, b) {
+		values[k] = v
+	}
+
+	err = out.Write(b.Samples)
+	if err != nil {
+		log.Println(err)
+		log.Printf("Error while writing the stats for %s\n", s.UUID)
+	}
+
+	prom.Update(s, values)
+}
+
+// use this to match on CPU keys
+var cpuTime = regexp.MustCompile("cpu[0-9]+_time$")
+
+/*
+hypervisorWorker polls os-hypervisors for the capacity and usage of every
+compute host and writes it to the "OpenStack hypervisor" measurement.
+This needs admin so it's only run with the site scope.
+*/
+func hypervisorWorker(ctx context.Context, conf config.Sysconfig, c *collector, out sink.Sink) {
+	collection := conf.Collection
+	schedule(ctx, collection.HypervisorInterval.Duration, collection.Jitter.Duration, collection.Align, func(stamp, _ time.Time) {
+		err := hypervisorStats(ctx, c, out, stamp, collection.HypervisorInterval.Duration)
+		if err != nil {
+			log.Println(err)
+			log.Printf("Error while getting hypervisor stats for %s\n", c)
+		}
+	})
+}
+
+func hypervisorStats(ctx context.Context, c *collector, out sink.Sink, stamp time.Time, timeout time.Duration) error {
+	svc, err := c.services(ctx, timeout)
+	if err != nil {
+		return err
+	}
+
+	allPages, err := hypervisors.List(svc.compute, nil).AllPages()
+	if err != nil {
+		return err
+	}
+	allHypervisors, err := hypervisors.ExtractHypervisors(allPages)
+	if err != nil {
+		return err
+	}
+
+	b := sink.NewBatch(stamp)
+	for _, h := range allHypervisors {
+		tags := map[string]string{
+			// The same tag the instance points have, so the two can be joined
+			"hypervisor_hostname": h.HypervisorHostname,
+			"Hypervisor Type":     h.HypervisorType,
+			"State":               h.State,
+			"Status":              h.Status,
+			"cloud":               c.name,
+		}
+		if c.conf.Region != "" {
+			tags["region"] = c.conf.Region
+		}
+		fields := map[string]float64{
+			"vcpus":                float64(h.VCPUs),
+			"vcpus_used":           float64(h.VCPUsUsed),
+			"memory_mb":            float64(h.MemoryMB),
+			"memory_mb_used":       float64(h.MemoryMBUsed),
+			"free_ram_mb":          float64(h.FreeRamMB),
+			"local_gb":             float64(h.LocalGB),
+			"local_gb_used":        float64(h.LocalGBUsed),
+			"free_disk_gb":         float64(h.FreeDiskGB),
+			"disk_available_least": float64(h.DiskAvailableLeast),
+			"running_vms":          float64(h.RunningVMs),
+			"current_workload":     float64(h.CurrentWorkload),
+			"up":                   boolFloat(h.State == "up"),
+			"enabled":              boolFloat(h.Status == "enabled"),
+		}
+		b.Fields("OpenStack hypervisor", tags, fields)
 	}
+	return out.Write(b.Samples)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 // Sum up the CPU totals and write it out... Using legacy metric name. (I was dumb)
-func cpuStats(server metrics.Vms, stats map[string]interface{}, dbapi api.WriteAPI) error {
-	// use this to match on CPU keys
-	re, _ := regexp.Compile("cpu[0-9]+_time$")
+// The v2 naming profile writes it as cpu_time_total.
+func cpuStats(server metrics.Vms, stats map[string]interface{}, b *sink.Batch) (float64, error) {
 	var cpu_total float64
 
 	for k, v := range stats {
-		if re.MatchString(k) {
+		if cpuTime.MatchString(k) {
 			cpu_value, err := getFloat(v)
 			if err != nil {
-				return err
+				return 0, err
 			}
 			cpu_total = cpu_total + cpu_value
 		}
 	}
 
-	influx.WritePoint(server, "OpenStack Metrics", "cpu_total", cpu_total, dbapi)
-	return nil
+	b.Point(server, "OpenStack Metrics", "cpu_total", cpu_total)
+	return cpu_total, nil
 }
 
-// Function to accumulate various disk IO statistics on a instance VM
-func ioStats(server metrics.Vms, stats map[string]interface{}, dbapi api.WriteAPI) error {
-	// vdX device io requests and
-	vdr, _ := regexp.Compile("vd.+read_req$")
-	vdw, _ := regexp.Compile("vd.+write_req$")
-	hdr, _ := regexp.Compile("hd.+read_req$")
-	hdw, _ := regexp.Compile("hd.+write_req$")
-	var vdr_total, vdw_total, hdr_total, hdw_total, ior, iow float64
+// The networks the IP tag is taken from, collection.primary_network. nil for any network.
+var primaryNetwork *regexp.Regexp
+
+// The disk key patterns built so far, by the device families they're for
+var diskPatterns sync.Map
+
+/*
+Matches the disk keys of the device families, vda_read_req or sdb_write for
+example. Each set of families is only compiled the first time.
+*/
+func diskPattern(families []string) *regexp.Regexp {
+	joined := strings.Join(families, "|")
+	if re, found := diskPatterns.Load(joined); found {
+		return re.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile("^(" + joined + ")[a-z]+_(read|write|errors)(_req)?$")
+	diskPatterns.Store(joined, re)
+	return re
+}
+
+/*
+Function to accumulate various disk IO statistics on a instance VM, returns the totals written.
+Each device gets its own points in the "OpenStack disk" measurement tagged with
+the device name, along with the request totals per device family (vd_read_ops,
+hd_write_ops...) and for the whole instance.
+*/
+func ioStats(server metrics.Vms, stats map[string]interface{}, families []string, b *sink.Batch) (map[string]float64, error) {
+	devices := make(map[string]map[string]float64)
+	totals := make(map[string]float64)
 
+	// Always write the family totals, even with no devices of that kind
+	for _, family := range families {
+		totals[family+"_read_ops"] = 0
+		totals[family+"_write_ops"] = 0
+	}
+	for _, f := range []string{"read_ops", "write_ops", "read_bytes", "write_bytes", "errors"} {
+		totals["total_"+f] = 0
+	}
+
+	diskKey := diskPattern(families)
 	for k, v := range stats {
-		// Get vd* read/write ops
-		if vdr.MatchString(k) {
-			vdr_value, err := getFloat(v)
-			if err != nil {
-				return err
-			}
-			vdr_total = vdr_total + vdr_value
+		m := diskKey.FindStringSubmatch(k)
+		if m == nil {
+			continue
 		}
-		if vdw.MatchString(k) {
-			vdw_value, err := getFloat(v)
-			if err != nil {
-				return err
-			}
-			vdw_total = vdw_total + vdw_value
+		value, err := getFloat(v)
+		if err != nil {
+			return nil, err
 		}
 
-		// Get legacy hd* read/write ops
-		if hdr.MatchString(k) {
-			hdr_value, err := getFloat(v)
-			if err != nil {
-				return err
-			}
-			hdr_total = hdr_total + hdr_value
+		// vda_read_req is requests, vda_read is bytes
+		var field string
+		switch {
+		case m[2] == "errors":
+			field = "errors"
+		case m[3] == "_req":
+			field = m[2] + "_ops"
+			totals[m[1]+"_"+field] = totals[m[1]+"_"+field] + value
+		default:
+			field = m[2] + "_bytes"
 		}
-		if hdw.MatchString(k) {
-			hdw_value, err := getFloat(v)
-			if err != nil {
-				return err
+
+		device := strings.SplitN(k, "_", 2)[0]
+		if devices[device] == nil {
+			devices[device] = make(map[string]float64)
+		}
+		devices[device][field] = value
+		totals["total_"+field] = totals["total_"+field] + value
+	}
+
+	for device, fields := range devices {
+		tags := map[string]string{"Device": device}
+		for f, v := range fields {
+			b.TaggedPoint(server, "OpenStack disk", tags, f, v)
+		}
+	}
+
+	for k, v := range totals {
+		b.Point(server, "OpenStack disk", k, v)
+	}
+
+	return totals, nil
+}
+
+/*
+Work out guest memory usage from the balloon driver stats and write it to the
+"OpenStack memory" measurement. All the libvirt memory keys are KiB:
+memory is the allocation, memory-actual the current balloon size,
+memory-available what the guest can use and memory-unused what it has free.
+The standardized diagnostics only give us memory and memory-used.
+Anything we can't work out because the balloon driver didn't report it is left out.
+*/
+func memStats(server metrics.Vms, stats map[string]interface{}, b *sink.Batch) map[string]float64 {
+	mem := make(map[string]float64)
+	for _, k := range []string{"memory", "memory-actual", "memory-available", "memory-unused", "memory-rss", "memory-used"} {
+		if v, err := getFloat(stats[k]); err == nil {
+			mem[k] = v
+		}
+	}
+	fields := make(map[string]float64)
+
+	available, hasAvailable := mem["memory-available"]
+	unused, hasUnused := mem["memory-unused"]
+	if hasAvailable && hasUnused && available > 0 {
+		fields["memory_used_kb"] = available - unused
+		fields["memory_used_percent"] = (available - unused) / available * 100
+	} else if used, ok := mem["memory-used"]; ok {
+		fields["memory_used_kb"] = used
+		if mem["memory"] > 0 {
+			fields["memory_used_percent"] = used / mem["memory"] * 100
+		}
+	}
+
+	// How much of the allocation the qemu process actually holds
+	allocation, ok := mem["memory-actual"]
+	if !ok {
+		allocation = mem["memory"]
+	}
+	if rss, ok := mem["memory-rss"]; ok && allocation > 0 {
+		fields["memory_rss_ratio"] = rss / allocation
+	}
+
+	for k, v := range fields {
+		b.Point(server, "OpenStack memory", k, v)
+	}
+	return fields
+}
+
+// Neutron ports indexed by the tap device name libvirt uses and the mac address
+type portIndex struct {
+	byTap map[string]ports.Port
+	byMac map[string]ports.Port
+}
+
+// The ports of a server as of the last time Nova recorded a change to it
+type serverPorts struct {
+	updated time.Time
+	ports   []ports.Port
+}
+
+/*
+Index the Neutron ports of the instances so we can tag the interface stats with
+them. The ports are kept between passes and only looked up again for servers
+that are new or that Nova says have changed since, the first time round they're
+all listed in one go. Without a network client we just get an empty index.
+*/
+func neutronPorts(c *collector, client *gophercloud.ServiceClient, instances []metrics.Vms) (portIndex, error) {
+	idx := portIndex{
+		byTap: make(map[string]ports.Port),
+		byMac: make(map[string]ports.Port),
+	}
+	if client == nil {
+		return idx, nil
+	}
+
+	var stale []metrics.Vms
+	for _, s := range instances {
+		if cached, found := c.ports[s.UUID]; !found || !cached.updated.Equal(s.Updated) {
+			stale = append(stale, s)
+		}
+	}
+
+	var err error
+	if len(c.ports) == 0 && len(stale) > 0 {
+		err = listPorts(c, client, stale)
+	} else {
+		for _, s := range stale {
+			allPages, lookupErr := ports.List(client, ports.ListOpts{DeviceID: s.UUID}).AllPages()
+			if lookupErr != nil {
+				err = lookupErr
+				continue
+			}
+			serverPortList, lookupErr := ports.ExtractPorts(allPages)
+			if lookupErr != nil {
+				err = lookupErr
+				continue
 			}
-			hdw_total = hdw_total + hdw_value
+			c.ports[s.UUID] = serverPorts{updated: s.Updated, ports: serverPortList}
 		}
 	}
 
-	// Sum everything up!
-	ior = vdr_total + hdr_total
-	iow = vdw_total + hdw_total
+	// Forget the servers that are gone, whatever we couldn't look up is left untagged
+	current := make(map[string]serverPorts, len(instances))
+	for _, s := range instances {
+		if cached, found := c.ports[s.UUID]; found {
+			current[s.UUID] = cached
+		}
+	}
+	c.ports = current
 
-	influx.WritePoint(server, "OpenStack disk", "vd_read_ops", vdr_total, dbapi)
-	influx.WritePoint(server, "OpenStack disk", "vd_write_ops", vdw_total, dbapi)
-	influx.WritePoint(server, "OpenStack disk", "hd_read_ops", hdr_total, dbapi)
-	influx.WritePoint(server, "OpenStack disk", "hd_write_ops", hdw_total, dbapi)
-	influx.WritePoint(server, "OpenStack disk", "total_read_ops", ior, dbapi)
-	influx.WritePoint(server, "OpenStack disk", "total_write_ops", iow, dbapi)
+	for _, cached := range c.ports {
+		for _, port := range cached.ports {
+			// The tap device is named after the first 11 characters of the port id
+			if len(port.ID) >= 11 {
+				idx.byTap["tap"+port.ID[:11]] = port
+			}
+			idx.byMac[strings.ToLower(port.MACAddress)] = port
+		}
+	}
+	return idx, err
+}
 
+// Fill the port cache for the first time with one listing, of the project's ports when we only collect from one
+func listPorts(c *collector, client *gophercloud.ServiceClient, instances []metrics.Vms) error {
+	opts := ports.ListOpts{}
+	if c.conf.Scope != "site" {
+		opts.ProjectID = c.conf.ProjectID
+	}
+	allPages, err := ports.List(client, opts).AllPages()
+	if err != nil {
+		return err
+	}
+	allPorts, err := ports.ExtractPorts(allPages)
+	if err != nil {
+		return err
+	}
+
+	byServer := make(map[string][]ports.Port)
+	for _, port := range allPorts {
+		byServer[port.DeviceID] = append(byServer[port.DeviceID], port)
+	}
+	c.ports = make(map[string]serverPorts, len(instances))
+	for _, s := range instances {
+		c.ports[s.UUID] = serverPorts{updated: s.Updated, ports: byServer[s.UUID]}
+	}
 	return nil
 }
 
+// Interface stats, tapXXX_rx_packets or nic0_tx for the standardized diagnostics
+var netKey = regexp.MustCompile("^(.+)_(rx|tx)(_packets|_drop|_errors)?$")
 
+/*
+Add up the network stats for each vNIC and write out a point per interface and
+the totals for the instance to the "OpenStack network" measurement. Interfaces
+we can match to a Neutron port get the port id and mac address tags.
+*/
+func netStats(server metrics.Vms, stats map[string]interface{}, portIdx portIndex, b *sink.Batch) (map[string]float64, error) {
+	nics := make(map[string]map[string]float64)
+	totals := make(map[string]float64)
+
+	for k, v := range stats {
+		m := netKey.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		value, err := getFloat(v)
+		if err != nil {
+			return nil, err
+		}
+
+		// The byte counters are just _rx and _tx
+		field := m[2] + m[3]
+		if m[3] == "" {
+			field = m[2] + "_bytes"
+		}
+		if nics[m[1]] == nil {
+			nics[m[1]] = make(map[string]float64)
+		}
+		nics[m[1]][field] = value
+		totals["total_"+field] = totals["total_"+field] + value
+	}
+
+	for nic, fields := range nics {
+		tags := map[string]string{"Interface": nic}
+		port, found := portIdx.byTap[nic]
+		if !found {
+			// Standardized diagnostics give us the mac address instead
+			if mac, ok := stats[nic+"_mac"].(string); ok {
+				port, found = portIdx.byMac[strings.ToLower(mac)]
+			}
+		}
+		if found {
+			tags["Port ID"] = port.ID
+			tags["MAC"] = port.MACAddress
+		}
+
+		for f, v := range fields {
+			b.TaggedPoint(server, "OpenStack network", tags, f, v)
+		}
+	}
+
+	for k, v := range totals {
+		b.Point(server, "OpenStack network", k, v)
+	}
+	return totals, nil
+}
+
+/*
+Work out per second rates from the cumulative counters and write them to the
+"OpenStack rates" measurement. values holds the raw and generated metrics for
+this pass. The first pass for an instance, or the one after its counters reset,
+only sets the baseline so nothing is written for it.
+*/
+func rateStats(counterRates *metrics.Rates, server metrics.Vms, values map[string]float64, t time.Time, b *sink.Batch) map[string]float64 {
+	rates := make(map[string]float64)
+
+	// cpu time is nanoseconds summed over every vCPU
+	var vcpus float64
+	for k := range values {
+		if cpuTime.MatchString(k) {
+			vcpus++
+		}
+	}
+	// A resize or hotplug changes what cpu_total adds up, start it over
+	if counterRates.Changed(server.UUID, "vcpus", vcpus) {
+		counterRates.Reset(server.UUID, "cpu_total")
+	}
+	if cpuTotal, ok := values["cpu_total"]; ok && vcpus > 0 {
+		if r, ok := counterRates.Rate(server.UUID, "cpu_total", cpuTotal, t); ok {
+			rates["cpu_utilization_percent"] = r / 1e9 / vcpus * 100
+		}
+	}
+
+	counters := map[string]string{
+		"total_read_ops":    "read_iops",
+		"total_write_ops":   "write_iops",
+		"total_read_bytes":  "read_bytes_per_sec",
+		"total_write_bytes": "write_bytes_per_sec",
+		"total_rx_bytes":    "rx_bytes_per_sec",
+		"total_tx_bytes":    "tx_bytes_per_sec",
+		"total_rx_packets":  "rx_packets_per_sec",
+		"total_tx_packets":  "tx_packets_per_sec",
+	}
+	for counter, name := range counters {
+		if v, ok := values[counter]; ok {
+			if r, ok := counterRates.Rate(server.UUID, counter, v, t); ok {
+				rates[name] = r
+			}
+		}
+	}
+
+	for k, v := range rates {
+		b.Point(server, "OpenStack rates", k, v)
+	}
+	return rates
+}
 
 func getFloat(unk interface{}) (float64, error) {
 	var floatType = reflect.TypeOf(float64(0))
 	v := reflect.ValueOf(unk)
 	v = reflect.Indirect(v)
+	// null values in the diagnostics
+	if !v.IsValid() {
+		return 0, fmt.Errorf("cannot convert %v to float64", unk)
+	}
 	if !v.Type().ConvertibleTo(floatType) {
 		return 0, fmt.Errorf("cannot convert %v to float64", v.Type())
 	}
@@ -223,25 +943,65 @@ func getFloat(unk interface{}) (float64, error) {
 }
 
 func main() {
-	// Check the Enviromental Vars
-	osProvider, configuration := config.Startup()	
-
-	// Setup the Database connection
-	dbclient := influxdb2.NewClient(configuration.InfluxdbServer, configuration.Token)
-	health, err := dbclient.Health(context.Background())
-	if (err != nil) && health.Status == domain.HealthCheckStatusPass {
-		log.Panic(err)
-	}
-	writeAPI := dbclient.WriteAPI(configuration.Org, configuration.Bucket)
-	errorsCh := writeAPI.Errors()
-	// Catch any write errors
-	go func() {
-		for err := range errorsCh {
-			fmt.Printf("write error: %s\n", err.Error())
+	configFile := flag.String("config", "", "path to the YAML config file, environment variables override it")
+	flag.Parse()
+
+	// Load the config file and the Enviromental Vars
+	configuration, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if configuration.Collection.PrimaryNetwork != "" {
+		primaryNetwork = regexp.MustCompile(configuration.Collection.PrimaryNetwork)
+	}
+
+	instanceFilter, err := filter.New(configuration.Filters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tagger, err := tagging.New(configuration.Tags, configuration.Collection.InventoryInterval.Duration)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Setup the outputs, every sample goes to each of them
+	naming, err := sink.NewNaming(configuration.Outputs.Naming)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var sinks []sink.Sink
+	if configuration.Outputs.InfluxDB.Server != "" {
+		influxSink, err := influx.New(configuration.Outputs.InfluxDB, naming)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
+		sinks = append(sinks, influxSink)
+	}
+	if configuration.Outputs.InfluxDBUDP.Address != "" {
+		udpSink, err := influx.NewUDP(configuration.Outputs.InfluxDBUDP, naming)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, udpSink)
+	}
+	if configuration.Outputs.OTLP.Endpoint != "" {
+		otlpSink, err := otlp.New(configuration.Outputs.OTLP, naming)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, otlpSink)
+	}
+	outputs := sink.NewFanout(configuration.Outputs.QueueSize, sinks...)
+	outputs.SetCritical(configuration.Outputs.Critical)
 
-	r := handlers.Router(dbclient)
+	prom := prometheus.New()
+	prom.SetOutputs(outputs)
+	var metricsHandler http.Handler
+	if configuration.Outputs.Prometheus.Enabled {
+		metricsHandler = prom
+	}
+	collected := &collection{}
+	r := handlers.Router(collected, outputs, metricsHandler)
 
 	srv := &http.Server{
 		Addr:    ":" + configuration.WebPort,
@@ -252,8 +1012,16 @@ func main() {
 		srv.ListenAndServe()
 	}()
 
-	// Go into the main loop.
-	go statsWorker(configuration, osProvider, writeAPI)
+	// Go into the main loop, for each cloud and region on its own
+	ctx, stop := context.WithCancel(context.Background())
+	var targets sync.WaitGroup
+	for _, t := range configuration.Targets {
+		targets.Add(1)
+		go func(t config.OpenStack) {
+			defer targets.Done()
+			runTarget(ctx, configuration, t, instanceFilter, tagger, outputs, prom, collected)
+		}(t)
+	}
 
 	// Listen for Sigint or SigTerm and exit if you get them.
 	sigs := make(chan os.Signal, 1)
@@ -271,9 +1039,14 @@ func main() {
 	fmt.Println("Startup success v0.95")
 
 	<-done
-	// Close the Influxdb connection
-	writeAPI.Flush()
-	dbclient.Close()
+	// Let the passes that are running finish before the outputs go away
+	stop()
+	targets.Wait()
+	// Write out anything still queued and close the outputs
+	err = outputs.Close()
+	if err != nil {
+		log.Println(err)
+	}
 	// Shudown the webserver
 	srv.Shutdown(context.Background())
 	fmt.Println("exiting")
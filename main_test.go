@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+	"github.com/cheetahfox/openstack-instance-stats/metrics"
+	"github.com/cheetahfox/openstack-instance-stats/sink"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+)
+
+// A pass is cut off at its deadline, even with every diagnostics request stuck in Nova
+func TestCollectStatsDeadline(t *testing.T) {
+	c, f := fakeCollector(t)
+	var started, cancelled int64
+	release := make(chan struct{})
+	defer close(release)
+	f.mux.HandleFunc("GET /compute/v2.1/servers/{id}/diagnostics", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&started, 1)
+		select {
+		case <-r.Context().Done():
+			atomic.AddInt64(&cancelled, 1)
+		case <-release:
+		}
+	})
+
+	var conf config.Sysconfig
+	conf.Collection.Workers = 2
+	instances := []metrics.Vms{
+		{UUID: "a", Status: "ACTIVE"},
+		{UUID: "b", Status: "ACTIVE"},
+		{UUID: "c", Status: "ACTIVE"},
+		{UUID: "d", Status: "ACTIVE"},
+	}
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	// The http client timeout alone would let them run for a minute
+	svc, err := c.services(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		collectStats(ctx, conf, c, svc, nil, nil, instances, portIndex{}, deadline)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline) + time.Second):
+		t.Fatal("the pass ran on past its deadline")
+	}
+
+	if got := atomic.LoadInt64(&started); got != 2 {
+		t.Errorf("%d diagnostics requests sent, want one per worker", got)
+	}
+	// The server only finds out once the connection is gone
+	for wait := time.Now().Add(time.Second); atomic.LoadInt64(&cancelled) < 2 && time.Now().Before(wait); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&cancelled); got != 2 {
+		t.Errorf("%d requests cancelled at the deadline, want 2", got)
+	}
+}
+
+// The ports are listed once, after that only the servers that changed are looked up
+func TestNeutronPortsCached(t *testing.T) {
+	c, f := fakeCollector(t)
+	var listings, lookups int64
+	portsJSON := map[string]string{
+		"a": `{"id": "aaaaaaaa-1111-2222-3333-444444444444", "device_id": "a", "mac_address": "FA:16:3E:00:00:0A"}`,
+		"b": `{"id": "bbbbbbbb-1111-2222-3333-444444444444", "device_id": "b", "mac_address": "fa:16:3e:00:00:0b"}`,
+		"c": `{"id": "cccccccc-1111-2222-3333-444444444444", "device_id": "c", "mac_address": "fa:16:3e:00:00:0c"}`,
+	}
+	f.mux.HandleFunc("GET /network/v2.0/ports", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if device := r.URL.Query().Get("device_id"); device != "" {
+			atomic.AddInt64(&lookups, 1)
+			fmt.Fprintf(w, `{"ports": [%s]}`, portsJSON[device])
+			return
+		}
+		atomic.AddInt64(&listings, 1)
+		if r.URL.Query().Get("project_id") != "p1" {
+			t.Errorf("listed the ports of project %q, want p1", r.URL.Query().Get("project_id"))
+		}
+		fmt.Fprintf(w, `{"ports": [%s, %s]}`, portsJSON["a"], portsJSON["b"])
+	})
+	c.conf.Scope = "project"
+	svc, err := c.services(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	then := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name              string
+		instances         []metrics.Vms
+		listings, lookups int64
+		taps              []string
+	}{
+		{"first pass", []metrics.Vms{{UUID: "a", Updated: then}, {UUID: "b", Updated: then}}, 1, 0, []string{"tapaaaaaaaa-11", "tapbbbbbbbb-11"}},
+		{"nothing changed", []metrics.Vms{{UUID: "a", Updated: then}, {UUID: "b", Updated: then}}, 1, 0, []string{"tapaaaaaaaa-11", "tapbbbbbbbb-11"}},
+		{"new server", []metrics.Vms{{UUID: "a", Updated: then}, {UUID: "b", Updated: then}, {UUID: "c", Updated: then}}, 1, 1, []string{"tapaaaaaaaa-11", "tapbbbbbbbb-11", "tapcccccccc-11"}},
+		{"changed server", []metrics.Vms{{UUID: "a", Updated: then.Add(time.Hour)}, {UUID: "b", Updated: then}, {UUID: "c", Updated: then}}, 1, 2, []string{"tapaaaaaaaa-11", "tapbbbbbbbb-11", "tapcccccccc-11"}},
+		{"server gone", []metrics.Vms{{UUID: "a", Updated: then.Add(time.Hour)}, {UUID: "c", Updated: then}}, 1, 2, []string{"tapaaaaaaaa-11", "tapcccccccc-11"}},
+	}
+	for _, tt := range tests {
+		idx, err := neutronPorts(c, svc.network, tt.instances)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := atomic.LoadInt64(&listings); got != tt.listings {
+			t.Errorf("%s: %d listings, want %d", tt.name, got, tt.listings)
+		}
+		if got := atomic.LoadInt64(&lookups); got != tt.lookups {
+			t.Errorf("%s: %d lookups, want %d", tt.name, got, tt.lookups)
+		}
+		var taps []string
+		for tap := range idx.byTap {
+			taps = append(taps, tap)
+		}
+		sort.Strings(taps)
+		if !reflect.DeepEqual(taps, tt.taps) {
+			t.Errorf("%s: taps %v, want %v", tt.name, taps, tt.taps)
+		}
+		if _, found := idx.byMac["fa:16:3e:00:00:0a"]; !found {
+			t.Errorf("%s: the mac addresses aren't indexed in lower case", tt.name)
+		}
+	}
+}
+
+// A resize changes what cpu_total adds up, the rate starts over rather than jumping
+func TestRateStatsVCPUChange(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cpus := func(n int, total float64) map[string]float64 {
+		values := map[string]float64{"cpu_total": total}
+		for i := 0; i < n; i++ {
+			values[fmt.Sprintf("cpu%d_time", i)] = total / float64(n)
+		}
+		return values
+	}
+	tests := []struct {
+		name   string
+		values map[string]float64
+		want   map[string]float64
+	}{
+		{"first sample", cpus(2, 0), map[string]float64{}},
+		// 10s of cpu time over 10s on 2 vCPUs
+		{"two vcpus", cpus(2, 10e9), map[string]float64{"cpu_utilization_percent": 50}},
+		// 40s more cpu time would be 200% of two vCPUs
+		{"resized to four", cpus(4, 50e9), map[string]float64{}},
+		{"four vcpus", cpus(4, 90e9), map[string]float64{"cpu_utilization_percent": 100}},
+		{"with disk ops", map[string]float64{"cpu0_time": 0, "cpu1_time": 0, "cpu2_time": 0, "cpu3_time": 0, "cpu_total": 110e9, "total_read_ops": 100},
+			map[string]float64{"cpu_utilization_percent": 50}},
+	}
+
+	rates := metrics.NewRates()
+	server := metrics.Vms{UUID: "uuid"}
+	for i, tt := range tests {
+		stamp := start.Add(time.Duration(i) * 10 * time.Second)
+		b := sink.NewBatch(stamp)
+		got := rateStats(rates, server, tt.values, stamp, b)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: rates %v, want %v", tt.name, got, tt.want)
+		}
+		if len(b.Samples) != len(tt.want) {
+			t.Errorf("%s: %d rate points, want %d", tt.name, len(b.Samples), len(tt.want))
+		}
+	}
+}
+
+func TestIOStats(t *testing.T) {
+	stats := map[string]interface{}{
+		"vda_read_req":  10.0,
+		"vda_read":      4096.0,
+		"vda_write_req": 5.0,
+		"vda_write":     2048.0,
+		"vda_errors":    -1.0,
+		"vdb_read_req":  1.0,
+		"sda_read_req":  7.0,
+		"sda_write":     512.0,
+		"cpu0_time":     1e9,
+		"tap1_rx":       100.0,
+	}
+	tests := []struct {
+		name     string
+		families []string
+		want     map[string]float64
+		devices  []string
+	}{
+		{"virtio", []string{"vd"}, map[string]float64{
+			"vd_read_ops": 11, "vd_write_ops": 5,
+			"total_read_ops": 11, "total_write_ops": 5, "total_read_bytes": 4096, "total_write_bytes": 2048, "total_errors": -1,
+		}, []string{"vda", "vdb"}},
+		{"scsi", []string{"sd"}, map[string]float64{
+			"sd_read_ops": 7, "sd_write_ops": 0,
+			"total_read_ops": 7, "total_write_ops": 0, "total_read_bytes": 0, "total_write_bytes": 512, "total_errors": 0,
+		}, []string{"sda"}},
+		{"no devices of a family", []string{"vd", "xvd"}, map[string]float64{
+			"vd_read_ops": 11, "vd_write_ops": 5, "xvd_read_ops": 0, "xvd_write_ops": 0,
+			"total_read_ops": 11, "total_write_ops": 5, "total_read_bytes": 4096, "total_write_bytes": 2048, "total_errors": -1,
+		}, []string{"vda", "vdb"}},
+	}
+	for _, tt := range tests {
+		b := sink.NewBatch(time.Now())
+		got, err := ioStats(metrics.Vms{UUID: "uuid"}, stats, tt.families, b)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: totals %v, want %v", tt.name, got, tt.want)
+		}
+		devices := make(map[string]bool)
+		for _, s := range b.Samples {
+			if device, found := s.Tags["Device"]; found {
+				devices[device] = true
+			}
+		}
+		var names []string
+		for device := range devices {
+			names = append(names, device)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tt.devices) {
+			t.Errorf("%s: device points for %v, want %v", tt.name, names, tt.devices)
+		}
+	}
+
+	if _, err := ioStats(metrics.Vms{}, map[string]interface{}{"vda_read": "lots"}, []string{"vd"}, sink.NewBatch(time.Now())); err == nil {
+		t.Error("a value that isn't a number was taken")
+	}
+}
+
+func TestNetStats(t *testing.T) {
+	idx := portIndex{
+		byTap: map[string]ports.Port{"tapaaaaaaaa-11": {ID: "aaaaaaaa-1111", MACAddress: "fa:16:3e:00:00:0a"}},
+		byMac: map[string]ports.Port{"fa:16:3e:00:00:0b": {ID: "bbbbbbbb-1111", MACAddress: "fa:16:3e:00:00:0b"}},
+	}
+	tests := []struct {
+		name   string
+		stats  map[string]interface{}
+		totals map[string]float64
+		tags   map[string]map[string]string // by interface
+	}{
+		{"libvirt tap devices", map[string]interface{}{
+			"tapaaaaaaaa-11_rx":         100.0,
+			"tapaaaaaaaa-11_tx":         50.0,
+			"tapaaaaaaaa-11_rx_packets": 10.0,
+			"tapaaaaaaaa-11_rx_drop":    1.0,
+			"tapffffffff-11_rx":         20.0,
+			"memory":                    1024.0,
+		}, map[string]float64{"total_rx_bytes": 120, "total_tx_bytes": 50, "total_rx_packets": 10, "total_rx_drop": 1},
+			map[string]map[string]string{
+				"tapaaaaaaaa-11": {"Interface": "tapaaaaaaaa-11", "Port ID": "aaaaaaaa-1111", "MAC": "fa:16:3e:00:00:0a"},
+				"tapffffffff-11": {"Interface": "tapffffffff-11"},
+			}},
+		{"standardized by mac", map[string]interface{}{
+			"nic0_rx":        300.0,
+			"nic0_tx_errors": 2.0,
+			"nic0_mac":       "FA:16:3E:00:00:0B",
+		}, map[string]float64{"total_rx_bytes": 300, "total_tx_errors": 2},
+			map[string]map[string]string{
+				"nic0": {"Interface": "nic0", "Port ID": "bbbbbbbb-1111", "MAC": "fa:16:3e:00:00:0b"},
+			}},
+		{"no interfaces", map[string]interface{}{"cpu0_time": 1e9}, map[string]float64{}, map[string]map[string]string{}},
+	}
+	for _, tt := range tests {
+		b := sink.NewBatch(time.Now())
+		totals, err := netStats(metrics.Vms{UUID: "uuid"}, tt.stats, idx, b)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if !reflect.DeepEqual(totals, tt.totals) {
+			t.Errorf("%s: totals %v, want %v", tt.name, totals, tt.totals)
+		}
+		tags := make(map[string]map[string]string)
+		for _, s := range b.Samples {
+			if nic, found := s.Tags["Interface"]; found {
+				tags[nic] = s.Tags
+			}
+		}
+		if !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("%s: interface tags %v, want %v", tt.name, tags, tt.tags)
+		}
+	}
+}
+
+func TestMemStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats map[string]interface{}
+		want  map[string]float64
+	}{
+		{"balloon driver", map[string]interface{}{
+			"memory": 4096.0, "memory-actual": 2048.0, "memory-available": 2000.0, "memory-unused": 500.0, "memory-rss": 1024.0,
+		}, map[string]float64{"memory_used_kb": 1500, "memory_used_percent": 75, "memory_rss_ratio": 0.5}},
+		{"no balloon stats", map[string]interface{}{
+			"memory": 4096.0, "memory-rss": 1024.0,
+		}, map[string]float64{"memory_rss_ratio": 0.25}},
+		{"standardized", map[string]interface{}{
+			"memory": 4096.0, "memory-used": 1024.0,
+		}, map[string]float64{"memory_used_kb": 1024, "memory_used_percent": 25}},
+		{"nothing available", map[string]interface{}{
+			"memory-available": 0.0, "memory-unused": 0.0, "memory-rss": nil,
+		}, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		b := sink.NewBatch(time.Now())
+		got := memStats(metrics.Vms{UUID: "uuid"}, tt.stats, b)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if len(b.Samples) != len(tt.want) {
+			t.Errorf("%s: %d memory points, want %d", tt.name, len(b.Samples), len(tt.want))
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"net"
+	"regexp"
+	"sort"
+)
+
+// Address is one of the addresses Nova lists for a server
+type Address struct {
+	Network  string
+	IP       net.IP
+	Floating bool // a floating ip rather than a fixed one on the port
+	MAC      string
+}
+
+/*
+ParseAddresses reads the addresses attribute of a server, a map of network
+name to a list of {addr, version, OS-EXT-IPS:type, OS-EXT-IPS-MAC:mac_addr}.
+The networks are sorted by name so the order is the same on every pass, the
+addresses of a network keep the order Nova gave them in. Anything that doesn't
+parse is skipped.
+*/
+func ParseAddresses(addresses map[string]interface{}) []Address {
+	networks := make([]string, 0, len(addresses))
+	for network := range addresses {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+
+	var parsed []Address
+	for _, network := range networks {
+		list, ok := addresses[network].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, a := range list {
+			attrs, ok := a.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			addr, _ := attrs["addr"].(string)
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				continue
+			}
+			kind, _ := attrs["OS-EXT-IPS:type"].(string)
+			mac, _ := attrs["OS-EXT-IPS-MAC:mac_addr"].(string)
+			parsed = append(parsed, Address{Network: network, IP: ip, Floating: kind == "floating", MAC: mac})
+		}
+	}
+	return parsed
+}
+
+/*
+PrimaryAddress picks the address we tag an instance with. Only networks whose
+name matches the rule are looked at (any network with a nil rule), fixed or
+floating addresses as asked, and IPv4 wins over IPv6. Without an address of
+the kind asked for we settle for the other kind on the same networks. Returns
+nil when no network matches.
+*/
+func PrimaryAddress(addresses []Address, network *regexp.Regexp, floating bool) net.IP {
+	var best net.IP
+	bestScore := -1
+	for _, a := range addresses {
+		if network != nil && !network.MatchString(a.Network) {
+			continue
+		}
+		score := 0
+		if a.Floating == floating {
+			score += 2
+		}
+		if a.IP.To4() != nil {
+			score++
+		}
+		// The first one wins a tie
+		if score > bestScore {
+			best = a.IP
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// FloatingIP is the floating ip on the same network as the fixed ip, nil without one
+func FloatingIP(addresses []Address, ip net.IP) net.IP {
+	var network string
+	found := false
+	for _, a := range addresses {
+		if a.IP.Equal(ip) && !a.Floating {
+			network = a.Network
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	for _, a := range addresses {
+		if a.Network == network && a.Floating {
+			return a.IP
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// What Nova lists for a server with a fixed and floating address on one network and two on another
+func novaAddresses() map[string]interface{} {
+	return map[string]interface{}{
+		"public": []interface{}{
+			map[string]interface{}{"addr": "2001:db8::10", "version": 6.0, "OS-EXT-IPS:type": "fixed", "OS-EXT-IPS-MAC:mac_addr": "fa:16:3e:00:00:02"},
+			map[string]interface{}{"addr": "203.0.113.10", "version": 4.0, "OS-EXT-IPS:type": "fixed", "OS-EXT-IPS-MAC:mac_addr": "fa:16:3e:00:00:02"},
+		},
+		"private": []interface{}{
+			map[string]interface{}{"addr": "10.0.0.5", "version": 4.0, "OS-EXT-IPS:type": "fixed", "OS-EXT-IPS-MAC:mac_addr": "fa:16:3e:00:00:01"},
+			map[string]interface{}{"addr": "198.51.100.7", "version": 4.0, "OS-EXT-IPS:type": "floating", "OS-EXT-IPS-MAC:mac_addr": "fa:16:3e:00:00:01"},
+			map[string]interface{}{"addr": "not an address"},
+			"garbage",
+		},
+		"broken": "garbage",
+	}
+}
+
+func TestParseAddresses(t *testing.T) {
+	want := []Address{
+		{Network: "private", IP: net.ParseIP("10.0.0.5"), MAC: "fa:16:3e:00:00:01"},
+		{Network: "private", IP: net.ParseIP("198.51.100.7"), Floating: true, MAC: "fa:16:3e:00:00:01"},
+		{Network: "public", IP: net.ParseIP("2001:db8::10"), MAC: "fa:16:3e:00:00:02"},
+		{Network: "public", IP: net.ParseIP("203.0.113.10"), MAC: "fa:16:3e:00:00:02"},
+	}
+	if got := ParseAddresses(novaAddresses()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := ParseAddresses(nil); got != nil {
+		t.Errorf("no addresses gave %v", got)
+	}
+}
+
+func TestPrimaryAddress(t *testing.T) {
+	addresses := ParseAddresses(novaAddresses())
+	v6only := []Address{{Network: "public", IP: net.ParseIP("2001:db8::10")}}
+	tests := []struct {
+		name      string
+		addresses []Address
+		network   string
+		floating  bool
+		want      string
+		floatIP   string
+	}{
+		{"any network", addresses, "", false, "10.0.0.5", "198.51.100.7"},
+		{"floating", addresses, "", true, "198.51.100.7", ""},
+		{"ipv4 wins", addresses, "^public$", false, "203.0.113.10", ""},
+		{"no floating on the network", addresses, "^public$", true, "203.0.113.10", ""},
+		{"only ipv6", v6only, "", false, "2001:db8::10", ""},
+		{"no network matches", addresses, "^storage$", false, "", ""},
+		{"no addresses", nil, "", false, "", ""},
+	}
+	for _, tt := range tests {
+		var network *regexp.Regexp
+		if tt.network != "" {
+			network = regexp.MustCompile(tt.network)
+		}
+		ip := PrimaryAddress(tt.addresses, network, tt.floating)
+		if got := ipString(ip); got != tt.want {
+			t.Errorf("%s: primary %s, want %s", tt.name, got, tt.want)
+		}
+		if got := ipString(FloatingIP(tt.addresses, ip)); got != tt.floatIP {
+			t.Errorf("%s: floating %s, want %s", tt.name, got, tt.floatIP)
+		}
+	}
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
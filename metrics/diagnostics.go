@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"fmt"
+)
+
+/*
+Diagnostics is the standardized server diagnostics document returned by Nova
+from microversion 2.48 onward. Older microversions return a flat map of
+hypervisor specific keys instead (cpu0_time, vda_read_req, tapXXX_rx etc).
+*/
+type Diagnostics struct {
+	State         string        `json:"state"`
+	Driver        string        `json:"driver"`
+	Hypervisor    string        `json:"hypervisor"`
+	HypervisorOS  string        `json:"hypervisor_os"`
+	Uptime        *float64      `json:"uptime"`
+	ConfigDrive   bool          `json:"config_drive"`
+	NumCPUs       int           `json:"num_cpus"`
+	NumDisks      int           `json:"num_disks"`
+	NumNics       int           `json:"num_nics"`
+	CPUDetails    []CPUDetail   `json:"cpu_details"`
+	DiskDetails   []DiskDetail  `json:"disk_details"`
+	NicDetails    []NicDetail   `json:"nic_details"`
+	MemoryDetails MemoryDetails `json:"memory_details"`
+}
+
+// CPU time is in nanoseconds, utilisation is a percentage
+type CPUDetail struct {
+	ID          int      `json:"id"`
+	Time        *float64 `json:"time"`
+	Utilisation *float64 `json:"utilisation"`
+}
+
+type DiskDetail struct {
+	ReadBytes     *float64 `json:"read_bytes"`
+	ReadRequests  *float64 `json:"read_requests"`
+	WriteBytes    *float64 `json:"write_bytes"`
+	WriteRequests *float64 `json:"write_requests"`
+	ErrorsCount   *float64 `json:"errors_count"`
+}
+
+type NicDetail struct {
+	MacAddress string   `json:"mac_address"`
+	RxOctets   *float64 `json:"rx_octets"`
+	RxErrors   *float64 `json:"rx_errors"`
+	RxDrop     *float64 `json:"rx_drop"`
+	RxPackets  *float64 `json:"rx_packets"`
+	RxRate     *float64 `json:"rx_rate"`
+	TxOctets   *float64 `json:"tx_octets"`
+	TxErrors   *float64 `json:"tx_errors"`
+	TxDrop     *float64 `json:"tx_drop"`
+	TxPackets  *float64 `json:"tx_packets"`
+	TxRate     *float64 `json:"tx_rate"`
+}
+
+// Memory is reported in MiB
+type MemoryDetails struct {
+	Maxmem *float64 `json:"maxmem"`
+	Used   *float64 `json:"used"`
+}
+
+/*
+Flatten turns the standardized document back into the legacy flat key names so
+everything downstream works the same whichever format Nova returned. The new
+format doesn't name disks or interfaces, so disks are named vda, vdb... in order
+and interfaces nic0, nic1... with their mac address under nicX_mac. Values that
+are null in the response are left out.
+*/
+func (d Diagnostics) Flatten() map[string]interface{} {
+	stats := make(map[string]interface{})
+	set := func(k string, v *float64) {
+		if v != nil {
+			stats[k] = *v
+		}
+	}
+
+	stats["state"] = d.State
+	stats["driver"] = d.Driver
+	stats["hypervisor"] = d.Hypervisor
+	stats["hypervisor_os"] = d.HypervisorOS
+	set("uptime", d.Uptime)
+	stats["num_cpus"] = float64(d.NumCPUs)
+	stats["num_disks"] = float64(d.NumDisks)
+	stats["num_nics"] = float64(d.NumNics)
+
+	for _, c := range d.CPUDetails {
+		set(fmt.Sprintf("cpu%d_time", c.ID), c.Time)
+		set(fmt.Sprintf("cpu%d_utilisation", c.ID), c.Utilisation)
+	}
+
+	for i, disk := range d.DiskDetails {
+		name := diskName(i)
+		set(name+"_read", disk.ReadBytes)
+		set(name+"_read_req", disk.ReadRequests)
+		set(name+"_write", disk.WriteBytes)
+		set(name+"_write_req", disk.WriteRequests)
+		set(name+"_errors", disk.ErrorsCount)
+	}
+
+	for i, nic := range d.NicDetails {
+		name := fmt.Sprintf("nic%d", i)
+		stats[name+"_mac"] = nic.MacAddress
+		set(name+"_rx", nic.RxOctets)
+		set(name+"_rx_errors", nic.RxErrors)
+		set(name+"_rx_drop", nic.RxDrop)
+		set(name+"_rx_packets", nic.RxPackets)
+		set(name+"_rx_rate", nic.RxRate)
+		set(name+"_tx", nic.TxOctets)
+		set(name+"_tx_errors", nic.TxErrors)
+		set(name+"_tx_drop", nic.TxDrop)
+		set(name+"_tx_packets", nic.TxPackets)
+		set(name+"_tx_rate", nic.TxRate)
+	}
+
+	// Legacy memory keys are KiB
+	if d.MemoryDetails.Maxmem != nil {
+		stats["memory"] = *d.MemoryDetails.Maxmem * 1024
+	}
+	if d.MemoryDetails.Used != nil {
+		stats["memory-used"] = *d.MemoryDetails.Used * 1024
+	}
+
+	return stats
+}
+
+// vda, vdb ... vdz, vdaa, vdab like libvirt names them
+func diskName(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('a'+i%26)) + name
+		i = i/26 - 1
+	}
+	return "vd" + name
+}
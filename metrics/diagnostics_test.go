@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     map[string]interface{}
+	}{
+		{
+			name: "full document",
+			document: `{
+				"state": "running",
+				"driver": "libvirt",
+				"hypervisor": "kvm",
+				"hypervisor_os": "ubuntu",
+				"uptime": 46664,
+				"config_drive": true,
+				"num_cpus": 2,
+				"num_disks": 1,
+				"num_nics": 1,
+				"cpu_details": [
+					{"id": 0, "time": 17300000000, "utilisation": 15},
+					{"id": 1, "time": 18300000000, "utilisation": 20}
+				],
+				"disk_details": [
+					{"read_bytes": 262144, "read_requests": 112, "write_bytes": 5778432, "write_requests": 488, "errors_count": 1}
+				],
+				"nic_details": [
+					{
+						"mac_address": "fa:16:3e:4c:2c:30",
+						"rx_octets": 2070139, "rx_errors": 0, "rx_drop": 0, "rx_packets": 26701, "rx_rate": null,
+						"tx_octets": 140208, "tx_errors": 0, "tx_drop": 0, "tx_packets": 662, "tx_rate": null
+					}
+				],
+				"memory_details": {"maxmem": 2048, "used": 1024}
+			}`,
+			want: map[string]interface{}{
+				"state":            "running",
+				"driver":           "libvirt",
+				"hypervisor":       "kvm",
+				"hypervisor_os":    "ubuntu",
+				"uptime":           float64(46664),
+				"num_cpus":         float64(2),
+				"num_disks":        float64(1),
+				"num_nics":         float64(1),
+				"cpu0_time":        float64(17300000000),
+				"cpu0_utilisation": float64(15),
+				"cpu1_time":        float64(18300000000),
+				"cpu1_utilisation": float64(20),
+				"vda_read":         float64(262144),
+				"vda_read_req":     float64(112),
+				"vda_write":        float64(5778432),
+				"vda_write_req":    float64(488),
+				"vda_errors":       float64(1),
+				"nic0_mac":         "fa:16:3e:4c:2c:30",
+				"nic0_rx":          float64(2070139),
+				"nic0_rx_errors":   float64(0),
+				"nic0_rx_drop":     float64(0),
+				"nic0_rx_packets":  float64(26701),
+				"nic0_tx":          float64(140208),
+				"nic0_tx_errors":   float64(0),
+				"nic0_tx_drop":     float64(0),
+				"nic0_tx_packets":  float64(662),
+				"memory":           float64(2048 * 1024),
+				"memory-used":      float64(1024 * 1024),
+			},
+		},
+		{
+			name: "nulls are left out",
+			document: `{
+				"state": "running",
+				"driver": "libvirt",
+				"hypervisor": "kvm",
+				"hypervisor_os": "ubuntu",
+				"uptime": null,
+				"num_cpus": 1,
+				"num_disks": 1,
+				"num_nics": 0,
+				"cpu_details": [{"id": 0, "time": null, "utilisation": null}],
+				"disk_details": [{"read_bytes": 10, "read_requests": null, "write_bytes": null, "write_requests": null, "errors_count": null}],
+				"nic_details": [],
+				"memory_details": {"maxmem": null, "used": null}
+			}`,
+			want: map[string]interface{}{
+				"state":         "running",
+				"driver":        "libvirt",
+				"hypervisor":    "kvm",
+				"hypervisor_os": "ubuntu",
+				"num_cpus":      float64(1),
+				"num_disks":     float64(1),
+				"num_nics":      float64(0),
+				"vda_read":      float64(10),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d Diagnostics
+			if err := json.Unmarshal([]byte(tt.document), &d); err != nil {
+				t.Fatal(err)
+			}
+			got := d.Flatten()
+			if !reflect.DeepEqual(got, tt.want) {
+				for k, v := range tt.want {
+					if !reflect.DeepEqual(got[k], v) {
+						t.Errorf("%s = %v, want %v", k, got[k], v)
+					}
+				}
+				for k, v := range got {
+					if _, found := tt.want[k]; !found {
+						t.Errorf("unexpected %s = %v", k, v)
+					}
+				}
+			}
+		})
+	}
+}
+
+// The flattened disk keys have to match what ioStats looks for
+func TestDiskName(t *testing.T) {
+	tests := []struct {
+		i    int
+		want string
+	}{
+		{0, "vda"},
+		{1, "vdb"},
+		{25, "vdz"},
+		{26, "vdaa"},
+		{27, "vdab"},
+		{51, "vdaz"},
+		{52, "vdba"},
+		{701, "vdzz"},
+		{702, "vdaaa"},
+	}
+	for _, tt := range tests {
+		if got := diskName(tt.i); got != tt.want {
+			t.Errorf("diskName(%d) = %q, want %q", tt.i, got, tt.want)
+		}
+	}
+}
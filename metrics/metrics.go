@@ -2,12 +2,47 @@ package metrics
 
 import (
 	"net"
+	"regexp"
+	"time"
 )
 
 type Vms struct {
-	UUID      string
-	Name      string
-	ProjectID string
-	IP        net.IP
-	Status    string
-}
\ No newline at end of file
+	UUID        string
+	Name        string
+	ProjectID   string
+	ProjectName string
+	DomainName  string
+	IP          net.IP // primary address, see PrimaryAddress
+	FloatingIP  net.IP // floating ip on the primary address's network
+	Addresses   []Address
+	Status      string
+	PowerState  int    // OS-EXT-STS:power_state, 1 is running
+	TaskState   string // what Nova is doing with it, empty when nothing
+	Created     time.Time
+	Updated     time.Time // the last change Nova recorded
+	Flavor      Flavor
+	Hypervisor  string // only visible to admins
+	Cloud       string
+	Region      string
+	Tags        map[string]string // promoted metadata and server tags
+}
+
+// RAM is in MB and Disk in GB like Nova reports them
+type Flavor struct {
+	ID    string
+	Name  string
+	VCPUs int
+	RAM   int
+	Disk  int
+}
+
+/*
+Libvirt counters only ever go up, cpu time, io requests, bytes, packets etc.
+The per device disk points have a plain errors field.
+*/
+var counterKey = regexp.MustCompile("((_time|_req|_read|_write|_errors|_drop|_rx|_tx|_packets|_bytes|_ops|_total)|^errors)$")
+
+// IsCounter reports if a diagnostics key is a cumulative counter rather than a gauge.
+func IsCounter(key string) bool {
+	return counterKey.MatchString(key)
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import "testing"
+
+func TestIsCounter(t *testing.T) {
+	tests := []struct {
+		key     string
+		counter bool
+	}{
+		{"cpu0_time", true},
+		{"vda_read_req", true},
+		{"vda_read", true},
+		{"vda_errors", true},
+		{"tap1234_rx", true},
+		{"tap1234_tx_drop", true},
+		{"tap1234_rx_packets", true},
+		{"total_read_bytes", true},
+		{"read_ops", true},
+		{"cpu_total", true},
+		// the per device disk points
+		{"errors", true},
+		{"memory", false},
+		{"memory-actual", false},
+		{"memory_used_percent", false},
+		{"read_iops", false},
+		{"rx_bytes_per_sec", false},
+		{"uptime", false},
+		{"rx_errors_ratio", false},
+	}
+	for _, tt := range tests {
+		if got := IsCounter(tt.key); got != tt.counter {
+			t.Errorf("IsCounter(%q) = %v, want %v", tt.key, got, tt.counter)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Rates keeps the previous sample of each counter per instance so cumulative
+libvirt counters can be turned into per second rates between passes.
+*/
+type Rates struct {
+	mu        sync.Mutex
+	instances map[string]*counters
+}
+
+type counters struct {
+	samples map[string]sample
+	seen    bool
+}
+
+type sample struct {
+	value float64
+	time  time.Time
+}
+
+func NewRates() *Rates {
+	return &Rates{instances: make(map[string]*counters)}
+}
+
+/*
+Rate records the value of a counter and returns how much it changed per second
+since the previous sample. ok is false when there is nothing to compare against
+yet, or the counter went backwards (the instance rebooted and reset it), the
+new value becomes the baseline for the next pass.
+*/
+func (r *Rates) Rate(uuid, key string, value float64, t time.Time) (rate float64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.instance(uuid)
+	prev, found := c.samples[key]
+	c.samples[key] = sample{value: value, time: t}
+
+	elapsed := t.Sub(prev.time).Seconds()
+	if !found || value < prev.value || elapsed <= 0 {
+		return 0, false
+	}
+	return (value - prev.value) / elapsed, true
+}
+
+/*
+Changed records a gauge value and reports if it's different from the previous
+one, used to notice things like a vCPU count change that invalidates a rate.
+*/
+func (r *Rates) Changed(uuid, key string, value float64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.instance(uuid)
+	prev, found := c.samples[key]
+	c.samples[key] = sample{value: value}
+	return found && prev.value != value
+}
+
+// Reset forgets the previous sample of a counter so the next one starts over.
+func (r *Rates) Reset(uuid, key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.instance(uuid).samples, key)
+}
+
+// Sweep drops the samples of any instance we haven't seen since the last Sweep.
+func (r *Rates) Sweep() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for uuid, c := range r.instances {
+		if !c.seen {
+			delete(r.instances, uuid)
+			continue
+		}
+		c.seen = false
+	}
+}
+
+// Must be called holding the lock
+func (r *Rates) instance(uuid string) *counters {
+	c, ok := r.instances[uuid]
+	if !ok {
+		c = &counters{samples: make(map[string]sample)}
+		r.instances[uuid] = c
+	}
+	c.seen = true
+	return c
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRate(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	type step struct {
+		value float64
+		after time.Duration // since start
+		rate  float64
+		ok    bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"first sample is the baseline", []step{
+			{100, 0, 0, false},
+		}},
+		{"steady counter", []step{
+			{100, 0, 0, false},
+			{250, 15 * time.Second, 10, true},
+			{400, 30 * time.Second, 10, true},
+		}},
+		{"unchanged counter", []step{
+			{100, 0, 0, false},
+			{100, 15 * time.Second, 0, true},
+		}},
+		{"reboot resets the counter", []step{
+			{1000, 0, 0, false},
+			{50, 15 * time.Second, 0, false},
+			{200, 30 * time.Second, 10, true},
+		}},
+		{"no time has passed", []step{
+			{100, 15 * time.Second, 0, false},
+			{200, 15 * time.Second, 0, false},
+			{350, 30 * time.Second, 10, true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRates()
+			for i, s := range tt.steps {
+				rate, ok := r.Rate("uuid", "total_read_ops", s.value, start.Add(s.after))
+				if ok != s.ok || rate != s.rate {
+					t.Errorf("step %d: Rate(%g) = %g, %v, want %g, %v", i, s.value, rate, ok, s.rate, s.ok)
+				}
+			}
+		})
+	}
+}
+
+func TestRateKeepsInstancesAndKeysApart(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewRates()
+	r.Rate("a", "total_read_ops", 100, start)
+	r.Rate("a", "total_write_ops", 1000, start)
+	r.Rate("b", "total_read_ops", 5000, start)
+
+	later := start.Add(10 * time.Second)
+	tests := []struct {
+		uuid, key string
+		value     float64
+		rate      float64
+	}{
+		{"a", "total_read_ops", 200, 10},
+		{"a", "total_write_ops", 1100, 10},
+		{"b", "total_read_ops", 5500, 50},
+	}
+	for _, tt := range tests {
+		rate, ok := r.Rate(tt.uuid, tt.key, tt.value, later)
+		if !ok || rate != tt.rate {
+			t.Errorf("Rate(%s, %s) = %g, %v, want %g, true", tt.uuid, tt.key, rate, ok, tt.rate)
+		}
+	}
+}
+
+func TestRatesSweep(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewRates()
+	r.Rate("kept", "total_read_ops", 100, start)
+	r.Rate("gone", "total_read_ops", 100, start)
+	r.Sweep()
+
+	// Only kept is seen in the next pass
+	r.Rate("kept", "total_read_ops", 200, start.Add(10*time.Second))
+	r.Sweep()
+
+	if _, ok := r.Rate("kept", "total_read_ops", 300, start.Add(20*time.Second)); !ok {
+		t.Error("the counters of an instance that was seen were swept")
+	}
+	if _, ok := r.Rate("gone", "total_read_ops", 300, start.Add(20*time.Second)); ok {
+		t.Error("the counters of an instance that wasn't seen were kept")
+	}
+}
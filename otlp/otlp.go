@@ -0,0 +1,365 @@
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+	metrics "github.com/cheetahfox/openstack-instance-stats/metrics"
+	"github.com/cheetahfox/openstack-instance-stats/sink"
+)
+
+// Reported as the instrumentation scope and service.name
+const scope = "openstack-instance-stats"
+
+// Cumulative series we haven't seen for this long are forgotten
+const staleSeries = time.Hour
+
+/*
+Sink exports the samples as OTLP metrics over http/protobuf or grpc. Each
+instance is a resource with its uuid, name, project, flavor and hypervisor as
+attributes. The cumulative libvirt counters become monotonic cumulative sums,
+everything we derive from them (rates, percentages, memory) becomes a gauge.
+Samples are gathered into batches of batch_size, or whatever we have every
+flush_interval, and a batch that fails to export is dropped.
+*/
+type Sink struct {
+	conf   config.OTLP
+	naming *sink.Naming
+	export exporter
+
+	mu      sync.Mutex
+	pending []sink.Sample
+
+	flushMu sync.Mutex // guards series too
+	series  map[string]*series
+
+	exported uint64
+	dropped  uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// exporter sends an encoded ExportMetricsServiceRequest
+type exporter interface {
+	send(ctx context.Context, request []byte) error
+	close()
+}
+
+// When a cumulative series started, the counters can reset underneath us
+type series struct {
+	start uint64
+	last  float64
+	seen  time.Time
+}
+
+func New(conf config.OTLP, naming *sink.Naming) (*Sink, error) {
+	var export exporter
+	var err error
+	if conf.Protocol == "grpc" {
+		export, err = newGRPC(conf)
+	} else {
+		export, err = newHTTP(conf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sink{
+		conf:   conf,
+		naming: naming,
+		export: export,
+		series: make(map[string]*series),
+		done:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return "otlp"
+}
+
+// Write adds the samples to the pending batch, it's only exported once it's full or on the next flush
+func (s *Sink) Write(samples []sink.Sample) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, samples...)
+	full := len(s.pending) >= s.conf.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		s.flush()
+	}
+	return nil
+}
+
+func (s *Sink) Stats() map[string]float64 {
+	return map[string]float64{
+		"written_points_total": float64(atomic.LoadUint64(&s.exported)),
+		"dropped_points_total": float64(atomic.LoadUint64(&s.dropped)),
+	}
+}
+
+func (s *Sink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	s.flush()
+	s.export.close()
+	return nil
+}
+
+func (s *Sink) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.conf.FlushInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Sink) flush() {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	samples := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(samples) == 0 {
+		return
+	}
+
+	request, points := s.encode(samples, time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), s.conf.Timeout.Duration)
+	defer cancel()
+	err := s.export.send(ctx, request)
+	if err != nil {
+		fmt.Printf("write error: otlp: %s\n", err.Error())
+		atomic.AddUint64(&s.dropped, uint64(points))
+		return
+	}
+	atomic.AddUint64(&s.exported, uint64(points))
+}
+
+// One data point on its way into a metric
+type point struct {
+	attrs map[string]interface{}
+	start uint64
+	time  uint64
+	value float64
+}
+
+type metric struct {
+	cumulative bool
+	points     []point
+}
+
+type resource struct {
+	attrs   map[string]interface{}
+	metrics map[string]*metric
+}
+
+/*
+Encode the samples into an ExportMetricsServiceRequest, grouping them by
+instance and then by metric. Needs to be called holding flushMu.
+*/
+func (s *Sink) encode(samples []sink.Sample, now time.Time) ([]byte, int) {
+	resources := make(map[string]*resource)
+	points := 0
+
+	for _, sample := range samples {
+		key := ""
+		if sample.Instance != nil {
+			key = sample.Instance.Cloud + "/" + sample.Instance.Region + "/" + sample.Instance.UUID
+		}
+		r, found := resources[key]
+		if !found {
+			r = &resource{attrs: instanceAttributes(sample.Instance), metrics: make(map[string]*metric)}
+			resources[key] = r
+		}
+
+		attrs := make(map[string]interface{}, len(sample.Tags))
+		for k, v := range sample.Tags {
+			attrs[s.naming.Tag(k)] = v
+		}
+		t := uint64(sample.Time.UnixNano())
+
+		for field, value := range sample.Fields {
+			name := otlpName(s.naming.Measurement(sample.Measurement), s.naming.Field(field))
+			m, found := r.metrics[name]
+			if !found {
+				// Going by the legacy name, the counters might have been renamed
+				m = &metric{cumulative: metrics.IsCounter(field)}
+				r.metrics[name] = m
+			}
+			p := point{attrs: attrs, time: t, value: value}
+			if m.cumulative {
+				p.start = s.startTime(key+"\x00"+name+"\x00"+attributeKey(attrs), value, t, now)
+			}
+			m.points = append(m.points, p)
+			points++
+		}
+	}
+
+	// Forget the counters of instances that have gone away
+	for k, ser := range s.series {
+		if now.Sub(ser.seen) > staleSeries {
+			delete(s.series, k)
+		}
+	}
+
+	keys := make([]string, 0, len(resources))
+	for k := range resources {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var request []byte
+	for _, k := range keys {
+		request = appendMessage(request, requestResourceMetrics, resources[k].encode())
+	}
+	return request, points
+}
+
+/*
+The start of a cumulative series is when we first saw it, the first point has
+the same start and time which is how OTLP marks an unknown start. When the
+counter goes backwards the instance restarted and so does the series.
+*/
+func (s *Sink) startTime(key string, value float64, t uint64, now time.Time) uint64 {
+	ser, found := s.series[key]
+	if !found || value < ser.last {
+		ser = &series{start: t}
+		s.series[key] = ser
+	}
+	ser.last = value
+	ser.seen = now
+	return ser.start
+}
+
+func (r *resource) encode() []byte {
+	var res []byte
+	res = appendAttributes(res, resourceAttributes, r.attrs)
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sm []byte
+	var is []byte
+	is = appendString(is, scopeName, scope)
+	sm = appendMessage(sm, scopeMetricsScope, is)
+	for _, name := range names {
+		sm = appendMessage(sm, scopeMetricsMetrics, r.metrics[name].encode(name))
+	}
+
+	var rm []byte
+	rm = appendMessage(rm, resourceMetricsResource, res)
+	rm = appendMessage(rm, resourceMetricsScope, sm)
+	return rm
+}
+
+func (m *metric) encode(name string) []byte {
+	var data []byte
+	for _, p := range m.points {
+		var dp []byte
+		if p.start != 0 {
+			dp = appendFixed64(dp, pointStartTime, p.start)
+		}
+		dp = appendFixed64(dp, pointTime, p.time)
+		dp = appendDouble(dp, pointAsDouble, p.value)
+		dp = appendAttributes(dp, pointAttributes, p.attrs)
+		data = appendMessage(data, dataPoints, dp)
+	}
+
+	var b []byte
+	b = appendString(b, metricName, name)
+	if m.cumulative {
+		data = appendUint(data, sumAggregationTemporal, aggregationTemporalityCumulative)
+		data = appendBool(data, sumIsMonotonic, true)
+		return appendMessage(b, metricSum, data)
+	}
+	return appendMessage(b, metricGauge, data)
+}
+
+/*
+Instance resources use the OpenTelemetry host and cloud semantic conventions
+where they fit and openstack.* for the rest. Promoted metadata and server tags
+are added as they are named. Samples that aren't about an instance, like the
+hypervisors, share a resource with just the service.
+*/
+func instanceAttributes(vm *metrics.Vms) map[string]interface{} {
+	attrs := map[string]interface{}{
+		"service.name":   scope,
+		"cloud.provider": "openstack",
+	}
+	if vm == nil {
+		return attrs
+	}
+
+	for k, v := range vm.Tags {
+		attrs[k] = v
+	}
+	attrs["host.id"] = vm.UUID
+	attrs["host.name"] = vm.Name
+	attrs["openstack.project.id"] = vm.ProjectID
+	optional := map[string]string{
+		"openstack.cloud":               vm.Cloud,
+		"cloud.region":                  vm.Region,
+		"openstack.project.name":        vm.ProjectName,
+		"openstack.domain.name":         vm.DomainName,
+		"openstack.hypervisor.hostname": vm.Hypervisor,
+		"host.type":                     vm.Flavor.Name,
+	}
+	for k, v := range optional {
+		if v != "" {
+			attrs[k] = v
+		}
+	}
+	if vm.IP != nil {
+		attrs["host.ip"] = vm.IP.String()
+	}
+	if vm.FloatingIP != nil {
+		attrs["openstack.floating_ip"] = vm.FloatingIP.String()
+	}
+	if vm.Flavor.VCPUs > 0 {
+		attrs["openstack.flavor.vcpus"] = vm.Flavor.VCPUs
+		attrs["openstack.flavor.ram_mb"] = vm.Flavor.RAM
+		attrs["openstack.flavor.disk_gb"] = vm.Flavor.Disk
+	}
+	return attrs
+}
+
+// "OpenStack disk" and read_bytes become openstack.disk.read_bytes, openstack_disk.read_bytes with v2
+func otlpName(measurement, field string) string {
+	return strings.ToLower(strings.ReplaceAll(measurement, " ", ".")) + "." + field
+}
+
+// A stable key for a set of attributes
+func attributeKey(attrs map[string]interface{}) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%v\x00", k, attrs[k])
+	}
+	return b.String()
+}
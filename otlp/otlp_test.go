@@ -0,0 +1,490 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+	metrics "github.com/cheetahfox/openstack-instance-stats/metrics"
+	"github.com/cheetahfox/openstack-instance-stats/sink"
+)
+
+// What a collector would make of an ExportMetricsServiceRequest
+type exportedResource struct {
+	attrs   map[string]interface{}
+	scope   string
+	metrics map[string]exportedMetric
+}
+
+type exportedMetric struct {
+	sum         bool
+	temporality uint64
+	monotonic   bool
+	points      []exportedPoint
+}
+
+type exportedPoint struct {
+	start uint64
+	time  uint64
+	value float64
+	attrs map[string]interface{}
+}
+
+type pbField struct {
+	num   int
+	wire  int
+	value uint64 // varint and fixed64
+	bytes []byte
+}
+
+// Split a message into its fields, just the wire types we write
+func decodeFields(t *testing.T, b []byte) []pbField {
+	t.Helper()
+	var fields []pbField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad tag in %x", b)
+		}
+		b = b[n:]
+		f := pbField{num: int(tag >> 3), wire: int(tag & 7)}
+		switch f.wire {
+		case wireVarint:
+			f.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint for field %d", f.num)
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				t.Fatalf("short fixed64 for field %d", f.num)
+			}
+			f.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("bad length for field %d", f.num)
+			}
+			f.bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d for field %d", f.wire, f.num)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func decodeRequest(t *testing.T, request []byte) []exportedResource {
+	t.Helper()
+	var resources []exportedResource
+	for _, rm := range decodeFields(t, request) {
+		if rm.num != requestResourceMetrics {
+			t.Fatalf("unexpected field %d in the request", rm.num)
+		}
+		r := exportedResource{attrs: make(map[string]interface{}), metrics: make(map[string]exportedMetric)}
+		for _, f := range decodeFields(t, rm.bytes) {
+			switch f.num {
+			case resourceMetricsResource:
+				for _, a := range decodeFields(t, f.bytes) {
+					if a.num == resourceAttributes {
+						decodeAttribute(t, a.bytes, r.attrs)
+					}
+				}
+			case resourceMetricsScope:
+				decodeScopeMetrics(t, f.bytes, &r)
+			}
+		}
+		resources = append(resources, r)
+	}
+	return resources
+}
+
+func decodeScopeMetrics(t *testing.T, b []byte, r *exportedResource) {
+	for _, f := range decodeFields(t, b) {
+		switch f.num {
+		case scopeMetricsScope:
+			for _, s := range decodeFields(t, f.bytes) {
+				if s.num == scopeName {
+					r.scope = string(s.bytes)
+				}
+			}
+		case scopeMetricsMetrics:
+			var name string
+			var m exportedMetric
+			for _, mf := range decodeFields(t, f.bytes) {
+				switch mf.num {
+				case metricName:
+					name = string(mf.bytes)
+				case metricSum:
+					m.sum = true
+					fallthrough
+				case metricGauge:
+					for _, d := range decodeFields(t, mf.bytes) {
+						switch d.num {
+						case dataPoints:
+							m.points = append(m.points, decodePoint(t, d.bytes))
+						case sumAggregationTemporal:
+							m.temporality = d.value
+						case sumIsMonotonic:
+							m.monotonic = d.value == 1
+						}
+					}
+				}
+			}
+			if _, found := r.metrics[name]; found {
+				t.Errorf("%s sent twice for the same resource", name)
+			}
+			r.metrics[name] = m
+		}
+	}
+}
+
+func decodePoint(t *testing.T, b []byte) exportedPoint {
+	p := exportedPoint{attrs: make(map[string]interface{})}
+	for _, f := range decodeFields(t, b) {
+		switch f.num {
+		case pointStartTime:
+			p.start = f.value
+		case pointTime:
+			p.time = f.value
+		case pointAsDouble:
+			p.value = math.Float64frombits(f.value)
+		case pointAttributes:
+			decodeAttribute(t, f.bytes, p.attrs)
+		}
+	}
+	return p
+}
+
+func decodeAttribute(t *testing.T, b []byte, attrs map[string]interface{}) {
+	var key string
+	var value interface{}
+	for _, f := range decodeFields(t, b) {
+		switch f.num {
+		case keyValueKey:
+			key = string(f.bytes)
+		case keyValueValue:
+			for _, v := range decodeFields(t, f.bytes) {
+				switch v.num {
+				case anyStringValue:
+					value = string(v.bytes)
+				case anyBoolValue:
+					value = v.value == 1
+				case anyIntValue:
+					value = int(int64(v.value))
+				case anyDoubleValue:
+					value = math.Float64frombits(v.value)
+				}
+			}
+		}
+	}
+	attrs[key] = value
+}
+
+// A collector listening for http/protobuf, each request body is sent on the channel
+func httpReceiver(t *testing.T) (*httptest.Server, <-chan []byte) {
+	requests := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != httpPath {
+			t.Errorf("%s %s, want POST %s", r.Method, r.URL.Path, httpPath)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+			t.Errorf("Content-Type %q, want application/x-protobuf", ct)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- body
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+/*
+A collector listening for grpc over h2c that answers with the status, each
+message is unframed and sent on the channel.
+*/
+func grpcReceiver(t *testing.T, status, message string) (*httptest.Server, <-chan []byte) {
+	requests := make(chan []byte, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("grpc request over %s", r.Proto)
+		}
+		if r.URL.Path != grpcPath {
+			t.Errorf("request for %s, want %s", r.URL.Path, grpcPath)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/grpc" {
+			t.Errorf("Content-Type %q, want application/grpc", ct)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Errorf("badly framed grpc message %x", body)
+		} else {
+			requests <- body[5:]
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", status)
+		if message != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(message))
+		}
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func testConfig(endpoint, protocol string) config.OTLP {
+	return config.OTLP{
+		Endpoint:      endpoint,
+		Protocol:      protocol,
+		Timeout:       config.Duration{Duration: 5 * time.Second},
+		BatchSize:     1000,
+		FlushInterval: config.Duration{Duration: time.Hour}, // only flushed when the test says so
+	}
+}
+
+func testInstance() metrics.Vms {
+	return metrics.Vms{
+		UUID:        "2d3a6b9c-1111-4a4a-9b9b-000000000001",
+		Name:        "web-1",
+		ProjectID:   "8a1e7c",
+		ProjectName: "web",
+		DomainName:  "Default",
+		IP:          net.ParseIP("10.0.0.5"),
+		Flavor:      metrics.Flavor{Name: "m1.small", VCPUs: 2, RAM: 2048, Disk: 20},
+		Hypervisor:  "compute-1",
+		Cloud:       "prod",
+		Region:      "RegionOne",
+		Tags:        map[string]string{"env": "production"},
+	}
+}
+
+func receive(t *testing.T, requests <-chan []byte) []byte {
+	t.Helper()
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was exported")
+		return nil
+	}
+}
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		protocol string
+		receiver func(t *testing.T) (*httptest.Server, <-chan []byte)
+	}{
+		{"http/protobuf", httpReceiver},
+		{"grpc", func(t *testing.T) (*httptest.Server, <-chan []byte) { return grpcReceiver(t, "0", "") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			srv, requests := tt.receiver(t)
+			s, err := New(testConfig(srv.URL, tt.protocol), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			stamp := time.Date(2022, 1, 1, 0, 0, 15, 0, time.UTC)
+			vm := testInstance()
+			b := sink.NewBatch(stamp)
+			b.TaggedPoint(vm, "OpenStack disk", map[string]string{"Device": "vda"}, "errors", 3)
+			b.TaggedPoint(vm, "OpenStack disk", map[string]string{"Device": "vda"}, "read_bytes", 4096)
+			b.Point(vm, "OpenStack memory", "memory_used_percent", 42.5)
+			b.Fields("OpenStack hypervisor", map[string]string{"hypervisor_hostname": "compute-1"}, map[string]float64{"running_vms": 7})
+			s.Write(b.Samples)
+			s.flush()
+
+			resources := decodeRequest(t, receive(t, requests))
+			if len(resources) != 2 {
+				t.Fatalf("%d resources exported, want the instance and the hypervisors", len(resources))
+			}
+			var instance, other exportedResource
+			for _, r := range resources {
+				if r.attrs["host.id"] != nil {
+					instance = r
+				} else {
+					other = r
+				}
+				if r.scope != scope {
+					t.Errorf("scope %q, want %q", r.scope, scope)
+				}
+			}
+
+			wantAttrs := map[string]interface{}{
+				"service.name":                  scope,
+				"cloud.provider":                "openstack",
+				"cloud.region":                  "RegionOne",
+				"openstack.cloud":               "prod",
+				"host.id":                       vm.UUID,
+				"host.name":                     "web-1",
+				"host.ip":                       "10.0.0.5",
+				"host.type":                     "m1.small",
+				"openstack.project.id":          "8a1e7c",
+				"openstack.project.name":        "web",
+				"openstack.domain.name":         "Default",
+				"openstack.hypervisor.hostname": "compute-1",
+				"openstack.flavor.vcpus":        2,
+				"openstack.flavor.ram_mb":       2048,
+				"openstack.flavor.disk_gb":      20,
+				"env":                           "production",
+			}
+			if !reflect.DeepEqual(instance.attrs, wantAttrs) {
+				t.Errorf("instance resource attributes\n got %v\nwant %v", instance.attrs, wantAttrs)
+			}
+			wantAttrs = map[string]interface{}{"service.name": scope, "cloud.provider": "openstack"}
+			if !reflect.DeepEqual(other.attrs, wantAttrs) {
+				t.Errorf("hypervisor resource attributes %v, want %v", other.attrs, wantAttrs)
+			}
+
+			t0 := uint64(stamp.UnixNano())
+			wantMetrics := map[string]exportedMetric{
+				"openstack.disk.errors": {
+					sum: true, temporality: aggregationTemporalityCumulative, monotonic: true,
+					points: []exportedPoint{{start: t0, time: t0, value: 3, attrs: map[string]interface{}{"Device": "vda"}}},
+				},
+				"openstack.disk.read_bytes": {
+					sum: true, temporality: aggregationTemporalityCumulative, monotonic: true,
+					points: []exportedPoint{{start: t0, time: t0, value: 4096, attrs: map[string]interface{}{"Device": "vda"}}},
+				},
+				"openstack.memory.memory_used_percent": {
+					points: []exportedPoint{{time: t0, value: 42.5, attrs: map[string]interface{}{}}},
+				},
+			}
+			if !reflect.DeepEqual(instance.metrics, wantMetrics) {
+				t.Errorf("instance metrics\n got %+v\nwant %+v", instance.metrics, wantMetrics)
+			}
+			wantMetrics = map[string]exportedMetric{
+				"openstack.hypervisor.running_vms": {
+					points: []exportedPoint{{time: t0, value: 7, attrs: map[string]interface{}{"hypervisor_hostname": "compute-1"}}},
+				},
+			}
+			if !reflect.DeepEqual(other.metrics, wantMetrics) {
+				t.Errorf("hypervisor metrics\n got %+v\nwant %+v", other.metrics, wantMetrics)
+			}
+
+			if got := s.Stats()["written_points_total"]; got != 4 {
+				t.Errorf("%g points written, want 4", got)
+			}
+		})
+	}
+}
+
+// A cumulative series keeps its start until the counter goes backwards
+func TestExportStartTimeReset(t *testing.T) {
+	srv, requests := httpReceiver(t)
+	s, err := New(testConfig(srv.URL, "http/protobuf"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value float64
+		start int // pass the series started in
+	}{
+		{1000, 0},
+		{1500, 0},
+		// rebooted
+		{200, 2},
+		{700, 2},
+	}
+
+	vm := testInstance()
+	for i, tt := range tests {
+		stamp := start.Add(time.Duration(i) * 15 * time.Second)
+		b := sink.NewBatch(stamp)
+		b.Point(vm, "OpenStack Metrics", "cpu_total", tt.value)
+		s.Write(b.Samples)
+		s.flush()
+
+		resources := decodeRequest(t, receive(t, requests))
+		m := resources[0].metrics["openstack.metrics.cpu_total"]
+		if !m.sum || !m.monotonic || len(m.points) != 1 {
+			t.Fatalf("pass %d: cpu_total exported as %+v, want a monotonic sum", i, m)
+		}
+		want := uint64(start.Add(time.Duration(tt.start) * 15 * time.Second).UnixNano())
+		if p := m.points[0]; p.start != want || p.time != uint64(stamp.UnixNano()) || p.value != tt.value {
+			t.Errorf("pass %d: point %+v, want start %d", i, p, want)
+		}
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		receiver func(t *testing.T) *httptest.Server
+		err      string
+	}{
+		{
+			name:     "http status",
+			protocol: "http/protobuf",
+			receiver: func(t *testing.T) *httptest.Server {
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "overloaded", http.StatusServiceUnavailable)
+				}))
+				t.Cleanup(srv.Close)
+				return srv
+			},
+			err: "503 Service Unavailable",
+		},
+		{
+			name:     "grpc status",
+			protocol: "grpc",
+			receiver: func(t *testing.T) *httptest.Server {
+				srv, _ := grpcReceiver(t, "8", "too many requests, slow down")
+				return srv
+			},
+			err: "grpc status 8: too many requests, slow down",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := tt.receiver(t)
+			s, err := New(testConfig(srv.URL, tt.protocol), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			b := sink.NewBatch(time.Now())
+			b.Point(testInstance(), "OpenStack Metrics", "cpu_total", 1)
+			request, _ := s.encode(b.Samples, time.Now())
+			err = s.export.send(t.Context(), request)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("send returned %v, want %q", err, tt.err)
+			}
+
+			s.Write(b.Samples)
+			s.flush()
+			if got := s.Stats()["dropped_points_total"]; got != 1 {
+				t.Errorf("%g points dropped, want 1", got)
+			}
+		})
+	}
+}
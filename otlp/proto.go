@@ -0,0 +1,165 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+/*
+Just enough of the protobuf wire format to encode an OTLP metrics export
+request, so we don't need the generated code and the grpc module for it. Field
+numbers come from opentelemetry/proto/metrics/v1/metrics.proto and friends.
+*/
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// ExportMetricsServiceRequest
+const requestResourceMetrics = 1
+
+// ResourceMetrics
+const (
+	resourceMetricsResource = 1
+	resourceMetricsScope    = 2
+)
+
+// Resource
+const resourceAttributes = 1
+
+// ScopeMetrics
+const (
+	scopeMetricsScope   = 1
+	scopeMetricsMetrics = 2
+)
+
+// InstrumentationScope
+const (
+	scopeName    = 1
+	scopeVersion = 2
+)
+
+// Metric
+const (
+	metricName  = 1
+	metricGauge = 5
+	metricSum   = 7
+)
+
+// Gauge and Sum
+const (
+	dataPoints             = 1
+	sumAggregationTemporal = 2
+	sumIsMonotonic         = 3
+)
+
+// NumberDataPoint
+const (
+	pointStartTime  = 2
+	pointTime       = 3
+	pointAsDouble   = 4
+	pointAttributes = 7
+)
+
+// KeyValue and AnyValue
+const (
+	keyValueKey    = 1
+	keyValueValue  = 2
+	anyStringValue = 1
+	anyBoolValue   = 2
+	anyIntValue    = 3
+	anyDoubleValue = 4
+)
+
+const aggregationTemporalityCumulative = 2
+
+func appendTag(b []byte, field int, wire int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendUint(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendUint(b, field, 1)
+}
+
+func appendFixed64(b []byte, field int, v uint64) []byte {
+	b = appendTag(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func appendDouble(b []byte, field int, v float64) []byte {
+	return appendFixed64(b, field, math.Float64bits(v))
+}
+
+func appendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// Embedded messages are written even when empty, their presence can matter
+func appendMessage(b []byte, field int, msg []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// Attributes are string, int, float64 or bool values, written sorted by key
+func appendAttributes(b []byte, field int, attrs map[string]interface{}) []byte {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var value []byte
+		switch v := attrs[k].(type) {
+		case string:
+			value = appendTag(value, anyStringValue, wireBytes)
+			value = appendVarint(value, uint64(len(v)))
+			value = append(value, v...)
+		case bool:
+			value = appendUint(value, anyBoolValue, boolUint(v))
+		case int:
+			value = appendUint(value, anyIntValue, uint64(int64(v)))
+		case float64:
+			value = appendDouble(value, anyDoubleValue, v)
+		default:
+			continue
+		}
+		var kv []byte
+		kv = appendString(kv, keyValueKey, k)
+		kv = appendMessage(kv, keyValueValue, value)
+		b = appendMessage(b, field, kv)
+	}
+	return b
+}
+
+func boolUint(v bool) uint64 {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+)
+
+const (
+	httpPath = "/v1/metrics"
+	grpcPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+)
+
+// httpExporter posts the request to /v1/metrics with the http/protobuf encoding
+type httpExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTP(conf config.OTLP) (*httpExporter, error) {
+	transport, err := newTransport(conf, false)
+	if err != nil {
+		return nil, err
+	}
+	// The endpoint can be the collector or the full path
+	endpoint := strings.TrimSuffix(conf.Endpoint, "/")
+	if !strings.HasSuffix(endpoint, httpPath) {
+		endpoint += httpPath
+	}
+	return &httpExporter{
+		url:     endpoint,
+		headers: conf.Headers,
+		client:  &http.Client{Transport: transport},
+	}, nil
+}
+
+func (e *httpExporter) send(ctx context.Context, request []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A partial success still comes back as a 200, there's nothing we could do about the rest
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", e.url, resp.Status)
+	}
+	return nil
+}
+
+func (e *httpExporter) close() {
+	e.client.CloseIdleConnections()
+}
+
+/*
+grpcExporter calls MetricsService/Export. grpc is just a length prefixed
+message over http/2 with the status in the trailers, so the standard library
+client does the job: over TLS for https endpoints and with prior knowledge
+(h2c) for plain http ones, which is how collectors usually listen on 4317.
+*/
+type grpcExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newGRPC(conf config.OTLP) (*grpcExporter, error) {
+	transport, err := newTransport(conf, true)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcExporter{
+		url:     u.Scheme + "://" + u.Host + grpcPath,
+		headers: conf.Headers,
+		client:  &http.Client{Transport: transport},
+	}, nil
+}
+
+func (e *grpcExporter) send(ctx context.Context, request []byte) error {
+	// Not compressed, then the length
+	frame := make([]byte, 5, 5+len(request))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(request)))
+	frame = append(frame, request...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The trailers are only there once the body has been read
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", e.url, resp.Status)
+	}
+
+	// An error without a body sends its status in the headers instead
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		if m, err := url.PathUnescape(message); err == nil {
+			message = m
+		}
+		return fmt.Errorf("%s returned grpc status %s: %s", e.url, status, message)
+	}
+	return nil
+}
+
+func (e *grpcExporter) close() {
+	e.client.CloseIdleConnections()
+}
+
+func newTransport(conf config.OTLP, http2Only bool) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := conf.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	transport.ResponseHeaderTimeout = conf.Timeout.Duration
+
+	if http2Only {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return transport, nil
+}
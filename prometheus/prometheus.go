@@ -1,18 +1,191 @@
 package prometheus
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
 	metrics "github.com/cheetahfox/openstack-instance-stats/metrics"
 )
 
-// Prometheus is a struct that holds the configuration for the prometheus client
+// Prefix for every metric name we expose
+const namespace = "openstack_instance_"
+
+// Prefix for the metrics about our own outputs
+const outputNamespace = "openstack_stats_output_"
+
+var invalidChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// Prometheus holds the latest values collected for each instance and renders
+// them in the Prometheus text format when /metrics is scraped.
 type Prometheus struct {
+	mu      sync.RWMutex
+	hosts   map[string]*host
+	outputs OutputStats
+}
+
+// OutputStats reports counters about each output, keyed by the output name
+type OutputStats interface {
+	OutputStats() map[string]map[string]float64
+}
+
+// Values for a single instance, seen is cleared on every Sweep
+type host struct {
+	vm     metrics.Vms
+	values map[string]float64
+	seen   bool
+}
+
+func New() *Prometheus {
+	return &Prometheus{hosts: make(map[string]*host)}
+}
+
+// Update replaces the values we hold for an instance with the ones from this pass.
+func (p *Prometheus) Update(s metrics.Vms, values map[string]float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hosts[s.UUID] = &host{vm: s, values: values, seen: true}
+}
+
+// SetOutputs exports the stats of the outputs along with the instance metrics
+func (p *Prometheus) SetOutputs(o OutputStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outputs = o
+}
+
+/*
+Sweep is called at the end of each collection pass of a cloud and region. Any
+of its instances that wasn't updated since the last Sweep is gone (deleted,
+shut off or failing) so we drop its series instead of exporting stale values forever.
+*/
+func (p *Prometheus) Sweep(cloud, region string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for uuid, h := range p.hosts {
+		if h.vm.Cloud != cloud || h.vm.Region != region {
+			continue
+		}
+		if !h.seen {
+			delete(p.hosts, uuid)
+			continue
+		}
+		h.seen = false
+	}
+}
+
+// ServeHTTP writes out every metric we hold in the text exposition format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	// Group the samples by metric so each gets a single TYPE line
+	series := make(map[string][]string)
+	for _, h := range p.hosts {
+		labels := instanceLabels(h.vm)
+		for k, v := range h.values {
+			series[k] = append(series[k], fmt.Sprintf("{%s} %g", labels, v))
+		}
+	}
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, k := range keys {
+		name, kind := metricName(k)
+		fmt.Fprintf(w, "# HELP %s Nova diagnostics value %s\n", name, k)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		sort.Strings(series[k])
+		for _, line := range series[k] {
+			fmt.Fprintf(w, "%s%s\n", name, line)
+		}
+	}
+
+	if p.outputs != nil {
+		writeOutputs(w, p.outputs.OutputStats())
+	}
+}
+
+// Queue depths, written and dropped points and the like for each output
+func writeOutputs(w io.Writer, outputs map[string]map[string]float64) {
+	series := make(map[string][]string)
+	for output, stats := range outputs {
+		for k, v := range stats {
+			series[k] = append(series[k], fmt.Sprintf("{output=\"%s\"} %g", escape(output), v))
+		}
+	}
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := outputNamespace + invalidChars.ReplaceAllString(k, "_")
+		kind := "gauge"
+		if strings.HasSuffix(name, "_total") {
+			kind = "counter"
+		}
+		fmt.Fprintf(w, "# HELP %s Output stat %s\n", name, k)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		sort.Strings(series[k])
+		for _, line := range series[k] {
+			fmt.Fprintf(w, "%s%s\n", name, line)
+		}
+	}
+}
+
+// Work out the exposed name and type for a diagnostics key
+func metricName(key string) (string, string) {
+	name := namespace + invalidChars.ReplaceAllString(key, "_")
+	if !metrics.IsCounter(key) {
+		return name, "gauge"
+	}
+	if !strings.HasSuffix(name, "_total") {
+		name = name + "_total"
+	}
+	return name, "counter"
+}
+
+var instanceLabelNames = map[string]bool{
+	"instance_name": true, "uuid": true, "project": true, "cloud": true, "region": true, "ip": true, "floating_ip": true,
 }
 
-type Metrics struct {
-	hosts[] metrics.Vms
+// The promoted metadata and server tags come after ours, they can't replace them
+func instanceLabels(vm metrics.Vms) string {
+	labels := fmt.Sprintf("instance_name=\"%s\",uuid=\"%s\",project=\"%s\",cloud=\"%s\",region=\"%s\"",
+		escape(vm.Name), escape(vm.UUID), escape(vm.ProjectID), escape(vm.Cloud), escape(vm.Region))
+	if vm.IP != nil {
+		labels += fmt.Sprintf(",ip=\"%s\"", vm.IP)
+	}
+	if vm.FloatingIP != nil {
+		labels += fmt.Sprintf(",floating_ip=\"%s\"", vm.FloatingIP)
+	}
 
+	names := make([]string, 0, len(vm.Tags))
+	for k := range vm.Tags {
+		if !instanceLabelNames[k] {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		labels += fmt.Sprintf(",%s=\"%s\"", k, escape(vm.Tags[k]))
+	}
+	return labels
 }
 
-func updateMetrics() {
-	// This is where the prometheus client will be updated
+func escape(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
 }
@@ -0,0 +1,85 @@
+package prometheus
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	metrics "github.com/cheetahfox/openstack-instance-stats/metrics"
+)
+
+type fakeOutputs map[string]map[string]float64
+
+func (f fakeOutputs) OutputStats() map[string]map[string]float64 { return f }
+
+func scrape(p *Prometheus) string {
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestExposition(t *testing.T) {
+	p := New()
+	p.Update(metrics.Vms{UUID: "a", Name: "web-1", ProjectID: "p1", Cloud: "prod", Region: "r1"},
+		map[string]float64{"cpu_total": 5e9, "memory-actual": 2048, "vda_read_req": 10})
+	p.Update(metrics.Vms{UUID: "b", Name: `say "hi"`, ProjectID: "p1", Cloud: "prod", Region: "r1",
+		IP: net.ParseIP("10.0.0.5"), Tags: map[string]string{"team": "db", "uuid": "spoofed"}},
+		map[string]float64{"memory-actual": 4096})
+	p.SetOutputs(fakeOutputs{
+		"influxdb": {"queue_batches": 2, "written_points_total": 100, "healthy": 1},
+	})
+	got := scrape(p)
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"counter", "# TYPE openstack_instance_cpu_total counter"},
+		{"counter value", `openstack_instance_cpu_total{instance_name="web-1",uuid="a",project="p1",cloud="prod",region="r1"} 5e+09`},
+		{"counter gets _total", "# TYPE openstack_instance_vda_read_req_total counter"},
+		{"gauge", "# TYPE openstack_instance_memory_actual gauge"},
+		{"escaped and extra labels", `openstack_instance_memory_actual{instance_name="say \"hi\"",uuid="b",project="p1",cloud="prod",region="r1",ip="10.0.0.5",team="db"} 4096`},
+		{"output gauge", `openstack_stats_output_queue_batches{output="influxdb"} 2`},
+		{"output health", `openstack_stats_output_healthy{output="influxdb"} 1`},
+		{"output counter", "# TYPE openstack_stats_output_written_points_total counter"},
+	}
+	for _, tt := range tests {
+		if !strings.Contains(got, tt.line+"\n") {
+			t.Errorf("%s: no line %s in\n%s", tt.name, tt.line, got)
+		}
+	}
+	if strings.Count(got, "# TYPE openstack_instance_memory_actual ") != 1 {
+		t.Error("a metric has more than one TYPE line")
+	}
+}
+
+// Instances a pass didn't see are dropped, only for the cloud and region of the pass
+func TestSweep(t *testing.T) {
+	p := New()
+	update := func(uuid, region string) {
+		p.Update(metrics.Vms{UUID: uuid, Cloud: "prod", Region: region}, map[string]float64{"memory": 1})
+	}
+	update("kept", "r1")
+	update("gone", "r1")
+	update("other", "r2")
+	p.Sweep("prod", "r1")
+
+	update("kept", "r1")
+	p.Sweep("prod", "r1")
+
+	got := scrape(p)
+	tests := []struct {
+		uuid string
+		want bool
+	}{
+		{"kept", true},
+		{"gone", false},
+		{"other", true},
+	}
+	for _, tt := range tests {
+		if found := strings.Contains(got, `uuid="`+tt.uuid+`"`); found != tt.want {
+			t.Errorf("%s exported %v, want %v", tt.uuid, found, tt.want)
+		}
+	}
+}
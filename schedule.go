@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+/*
+schedule calls pass every interval until ctx is done. With align the passes
+are due on multiples of the interval (:00, :15, :30 and :45 for 15s) and the
+points are stamped with that time, so every replica and every pass lines up
+and downsampling is predictable. Otherwise they're stamped with when the pass
+started. With jitter each pass starts a random delay up to jitter after it's
+due, which spreads replicas out over the interval. A pass is given the next due
+time as its deadline, one that runs long skips the passes it ran into.
+*/
+func schedule(ctx context.Context, interval, jitter time.Duration, align bool, pass func(stamp, deadline time.Time)) {
+	next := time.Now().Add(interval)
+	if align {
+		next = time.Now().Truncate(interval).Add(interval)
+	}
+	for {
+		start := next
+		if jitter > 0 {
+			start = start.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		timer := time.NewTimer(time.Until(start))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		stamp := next
+		if !align {
+			stamp = time.Now()
+		}
+		next = next.Add(interval)
+		pass(stamp, next)
+
+		for !next.After(time.Now()) {
+			next = next.Add(interval)
+		}
+	}
+}
+
+// What to stamp points with outside of schedule, the last due time when aligning
+func stampTime(interval time.Duration, align bool) time.Time {
+	if align {
+		return time.Now().Truncate(interval)
+	}
+	return time.Now()
+}
@@ -0,0 +1,179 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Fanout hands every batch to any number of sinks. Each sink has its own queue and
+goroutine, so a slow or broken sink only falls behind by itself. When a sink's
+queue is full its batches are dropped rather than holding up the collectors.
+*/
+type Fanout struct {
+	outputs  []*output
+	critical map[string]bool // sinks Health checks
+	wg       sync.WaitGroup
+
+	mu     sync.RWMutex // Write holds it for reading so Close can't close a queue under it
+	closed bool
+}
+
+type output struct {
+	sink    Sink
+	queue   chan []Sample
+	dropped uint64 // samples dropped because the queue was full
+	full    int32  // set while we are dropping, so we only log it once
+	failing int32  // set while writes to the sink fail
+}
+
+// How long OutputStats waits on a sink's own health check
+const healthTimeout = 5 * time.Second
+
+// NewFanout starts a writer for each sink, queueSize is the number of batches each one can fall behind.
+func NewFanout(queueSize int, sinks ...Sink) *Fanout {
+	f := &Fanout{}
+	for _, s := range sinks {
+		o := &output{sink: s, queue: make(chan []Sample, queueSize)}
+		f.outputs = append(f.outputs, o)
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			o.run()
+		}()
+	}
+	return f
+}
+
+func (f *Fanout) Name() string {
+	names := make([]string, len(f.outputs))
+	for i, o := range f.outputs {
+		names[i] = o.sink.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Write queues the batch for every sink, it never blocks. After Close it's an error.
+func (f *Fanout) Write(samples []Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return errors.New("outputs are closed")
+	}
+	for _, o := range f.outputs {
+		select {
+		case o.queue <- samples:
+			atomic.StoreInt32(&o.full, 0)
+		default:
+			atomic.AddUint64(&o.dropped, uint64(len(samples)))
+			if atomic.SwapInt32(&o.full, 1) == 0 {
+				log.Printf("Output %s is falling behind, dropping samples until it catches up\n", o.sink.Name())
+			}
+		}
+	}
+	return nil
+}
+
+// SetCritical picks the sinks, by name, that Health depends on. Call it before the Fanout is used.
+func (f *Fanout) SetCritical(names []string) {
+	f.critical = make(map[string]bool, len(names))
+	for _, name := range names {
+		f.critical[name] = true
+	}
+}
+
+/*
+OutputStats returns the stats of every sink by its name, along with the depth
+of its queue, the samples it has lost to a full queue and whether it's healthy.
+A sink that can check its backend is asked, for the others it's whether the
+last write worked.
+*/
+func (f *Fanout) OutputStats() map[string]map[string]float64 {
+	all := make(map[string]map[string]float64, len(f.outputs))
+	for _, o := range f.outputs {
+		healthy := atomic.LoadInt32(&o.failing) == 0
+		if c, ok := o.sink.(Checker); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+			healthy = c.Health(ctx) == nil
+			cancel()
+		}
+		stats := map[string]float64{
+			"queue_batches":               float64(len(o.queue)),
+			"queue_dropped_samples_total": float64(atomic.LoadUint64(&o.dropped)),
+			"healthy":                     0,
+		}
+		if healthy {
+			stats["healthy"] = 1
+		}
+		if s, ok := o.sink.(Stats); ok {
+			for k, v := range s.Stats() {
+				stats[k] = v
+			}
+		}
+		all[o.sink.Name()] = stats
+	}
+	return all
+}
+
+// Health fails if any of the critical sinks is down, or for sinks that can't be checked, failing to write
+func (f *Fanout) Health(ctx context.Context) error {
+	for _, o := range f.outputs {
+		if !f.critical[o.sink.Name()] {
+			continue
+		}
+		if c, ok := o.sink.(Checker); ok {
+			if err := c.Health(ctx); err != nil {
+				return fmt.Errorf("%s: %w", o.sink.Name(), err)
+			}
+		} else if atomic.LoadInt32(&o.failing) != 0 {
+			return fmt.Errorf("%s: the last write failed", o.sink.Name())
+		}
+	}
+	return nil
+}
+
+// Close writes out whatever is queued and closes every sink
+func (f *Fanout) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	for _, o := range f.outputs {
+		close(o.queue)
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+
+	var problems []string
+	for _, o := range f.outputs {
+		if err := o.sink.Close(); err != nil {
+			problems = append(problems, o.sink.Name()+": "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("closing outputs: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (o *output) run() {
+	for samples := range o.queue {
+		if err := o.sink.Write(samples); err != nil {
+			log.Printf("write error: %s: %s\n", o.sink.Name(), err)
+			atomic.StoreInt32(&o.failing, 1)
+			continue
+		}
+		atomic.StoreInt32(&o.failing, 0)
+	}
+}
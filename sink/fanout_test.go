@@ -0,0 +1,156 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// A sink that holds every write until it's released
+type fakeSink struct {
+	name     string
+	release  chan struct{}
+	health   error
+	writeErr error
+
+	mu      sync.Mutex
+	written int
+	closed  bool
+}
+
+func newFakeSink(name string) *fakeSink {
+	return &fakeSink{name: name, release: make(chan struct{})}
+}
+
+func (s *fakeSink) Name() string { return s.name }
+
+func (s *fakeSink) Write(samples []Sample) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written += len(samples)
+	return s.writeErr
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// A fakeSink that can check its backend
+type checkedSink struct {
+	*fakeSink
+}
+
+func (s checkedSink) Health(_ context.Context) error { return s.health }
+
+func samples(n int) []Sample {
+	return make([]Sample, n)
+}
+
+func TestFanoutDrop(t *testing.T) {
+	slow := newFakeSink("slow")
+	fast := newFakeSink("fast")
+	close(fast.release)
+	f := NewFanout(1, slow, fast)
+
+	// slow queues one batch and may have taken another, the rest are dropped
+	for i := 0; i < 5; i++ {
+		if err := f.Write(samples(2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := f.OutputStats()
+	if got := stats["slow"]["queue_dropped_samples_total"]; got < 6 || got > 8 {
+		t.Errorf("slow dropped %g samples, want 6 to 8", got)
+	}
+	if got := stats["fast"]["queue_dropped_samples_total"]; got > 8 {
+		t.Errorf("fast dropped %g samples", got)
+	}
+
+	close(slow.release)
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stats = f.OutputStats()
+	if written := float64(slow.written); written+stats["slow"]["queue_dropped_samples_total"] != 10 {
+		t.Errorf("slow wrote %g and dropped %g of 10 samples", written, stats["slow"]["queue_dropped_samples_total"])
+	}
+	if float64(fast.written)+stats["fast"]["queue_dropped_samples_total"] != 10 {
+		t.Errorf("fast wrote %d and dropped %g of 10 samples", fast.written, stats["fast"]["queue_dropped_samples_total"])
+	}
+}
+
+func TestFanoutClose(t *testing.T) {
+	s := newFakeSink("influxdb")
+	close(s.release)
+	f := NewFanout(10, s)
+	for i := 0; i < 3; i++ {
+		if err := f.Write(samples(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Write(nil); err != nil {
+		t.Errorf("an empty batch failed: %s", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.written != 3 || !s.closed {
+		t.Errorf("wrote %d of 3 samples, closed %v", s.written, s.closed)
+	}
+	if err := f.Write(samples(1)); err == nil {
+		t.Error("writing after Close worked")
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("closing twice: %s", err)
+	}
+}
+
+func TestFanoutHealth(t *testing.T) {
+	down := errors.New("down")
+	tests := []struct {
+		name     string
+		critical []string
+		health   error // of the sink that can be checked
+		writeErr error // of the one that can't
+		err      bool
+		healthy  map[string]float64
+	}{
+		{"nothing critical", nil, down, down, false, map[string]float64{"influxdb": 0, "otlp": 0}},
+		{"critical and up", []string{"influxdb", "otlp"}, nil, nil, false, map[string]float64{"influxdb": 1, "otlp": 1}},
+		{"critical check fails", []string{"influxdb"}, down, nil, true, map[string]float64{"influxdb": 0, "otlp": 1}},
+		{"critical write fails", []string{"otlp"}, nil, down, true, map[string]float64{"influxdb": 1, "otlp": 0}},
+		{"other output down", []string{"otlp"}, down, nil, false, map[string]float64{"influxdb": 0, "otlp": 1}},
+	}
+	for _, tt := range tests {
+		checked := checkedSink{newFakeSink("influxdb")}
+		checked.health = tt.health
+		close(checked.release)
+		written := newFakeSink("otlp")
+		written.writeErr = tt.writeErr
+		close(written.release)
+
+		f := NewFanout(1, checked, written)
+		f.SetCritical(tt.critical)
+		f.Write(samples(1))
+		// Close waits for the write so its outcome is known
+		f.Close()
+
+		if err := f.Health(context.Background()); (err != nil) != tt.err {
+			t.Errorf("%s: health %v, want error %v", tt.name, err, tt.err)
+		}
+		healthy := make(map[string]float64)
+		for name, stats := range f.OutputStats() {
+			healthy[name] = stats["healthy"]
+		}
+		if !reflect.DeepEqual(healthy, tt.healthy) {
+			t.Errorf("%s: healthy %v, want %v", tt.name, healthy, tt.healthy)
+		}
+	}
+}
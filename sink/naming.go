@@ -0,0 +1,191 @@
+package sink
+
+import (
+	"fmt"
+	"strings"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+)
+
+/*
+Naming maps the measurement, tag and field names the collectors use, which are
+the legacy ones, to the names the outputs write. A nil Naming writes the legacy
+names.
+*/
+type Naming struct {
+	measurements map[string]string
+	tags         map[string]string
+	fields       map[string]string
+	snakeFields  bool // - in field names becomes _
+}
+
+type profile struct {
+	measurements map[string]string
+	tags         map[string]string
+	fields       map[string]string
+	snakeFields  bool
+}
+
+/*
+Profiles are the built in naming schemes. legacy is what has always been
+written, v2 is snake_case all the way so the names work as they are in Flux,
+InfluxQL and anything else.
+*/
+var profiles = map[string]profile{
+	"legacy": {},
+	"v2": {
+		measurements: map[string]string{
+			"OpenStack Metrics":         "openstack_instance",
+			"OpenStack disk":            "openstack_disk",
+			"OpenStack memory":          "openstack_memory",
+			"OpenStack network":         "openstack_network",
+			"OpenStack rates":           "openstack_rates",
+			"OpenStack hypervisor":      "openstack_hypervisor",
+			"OpenStack inventory":       "openstack_inventory",
+			"OpenStack instance counts": "openstack_instance_counts",
+			"OpenStack events":          "openstack_events",
+		},
+		tags: map[string]string{
+			"Instance Name":   "instance_name",
+			"UUID":            "uuid",
+			"Project":         "project_id",
+			"Project Name":    "project_name",
+			"Domain Name":     "domain_name",
+			"Flavor":          "flavor",
+			"IP":              "ip",
+			"Floating IP":     "floating_ip",
+			"Device":          "device",
+			"Interface":       "interface",
+			"Port ID":         "port_id",
+			"MAC":             "mac",
+			"Hypervisor Type": "hypervisor_type",
+			"State":           "state",
+			"Status":          "status",
+			"Power State":     "power_state",
+			"Task State":      "task_state",
+			"Previous Status": "previous_status",
+			"Event":           "event",
+		},
+		fields: map[string]string{
+			"cpu_total": "cpu_time_total",
+		},
+		snakeFields: true,
+	},
+}
+
+// NewNaming builds the naming from a profile and the overrides on top of it
+func NewNaming(conf config.Naming) (*Naming, error) {
+	p, ok := profiles[conf.Profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown naming profile %q", conf.Profile)
+	}
+	n := &Naming{
+		measurements: merge(p.measurements, conf.Measurements),
+		tags:         merge(p.tags, conf.Tags),
+		fields:       merge(p.fields, conf.Fields),
+		snakeFields:  p.snakeFields,
+	}
+	return n, nil
+}
+
+func merge(base, overrides map[string]string) map[string]string {
+	m := make(map[string]string, len(base)+len(overrides))
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range overrides {
+		m[k] = v
+	}
+	return m
+}
+
+func (n *Naming) Measurement(m string) string {
+	if n == nil {
+		return m
+	}
+	if name, ok := n.measurements[m]; ok {
+		return name
+	}
+	return m
+}
+
+func (n *Naming) Tag(k string) string {
+	if n == nil {
+		return k
+	}
+	if name, ok := n.tags[k]; ok {
+		return name
+	}
+	return k
+}
+
+func (n *Naming) Field(f string) string {
+	if n == nil {
+		return f
+	}
+	if name, ok := n.fields[f]; ok {
+		return name
+	}
+	if n.snakeFields {
+		// memory-actual and friends straight from the diagnostics
+		return strings.ReplaceAll(f, "-", "_")
+	}
+	return f
+}
+
+/*
+Flatten gives the tags and fields of a sample for backends that have no
+notion of the instance. Instance samples carry the instance tags, and when we
+know the flavor its name as a tag and the vcpus, ram_mb and disk_gb as fields
+so they can be used in queries. Promoted metadata and server tags never
+replace one of our own tags.
+*/
+func (n *Naming) Flatten(s Sample) (map[string]string, map[string]interface{}) {
+	tags := make(map[string]string, len(s.Tags)+9)
+	fields := make(map[string]interface{}, len(s.Fields)+3)
+	if vm := s.Instance; vm != nil {
+		for k, v := range vm.Tags {
+			tags[n.Tag(k)] = v
+		}
+		tags[n.Tag("Instance Name")] = vm.Name
+		tags[n.Tag("UUID")] = vm.UUID
+		tags[n.Tag("Project")] = vm.ProjectID
+		if vm.Cloud != "" {
+			tags[n.Tag("cloud")] = vm.Cloud
+		}
+		if vm.Region != "" {
+			tags[n.Tag("region")] = vm.Region
+		}
+		if vm.Hypervisor != "" {
+			tags[n.Tag("hypervisor_hostname")] = vm.Hypervisor
+		}
+		// Names we couldn't resolve are left out, the Project tag always has the id
+		if vm.ProjectName != "" {
+			tags[n.Tag("Project Name")] = vm.ProjectName
+		}
+		if vm.DomainName != "" {
+			tags[n.Tag("Domain Name")] = vm.DomainName
+		}
+		if vm.Flavor.Name != "" {
+			tags[n.Tag("Flavor")] = vm.Flavor.Name
+		}
+		if vm.IP != nil {
+			tags[n.Tag("IP")] = vm.IP.String()
+		}
+		if vm.FloatingIP != nil {
+			tags[n.Tag("Floating IP")] = vm.FloatingIP.String()
+		}
+		if vm.Flavor.VCPUs > 0 {
+			fields[n.Field("vcpus")] = vm.Flavor.VCPUs
+			fields[n.Field("ram_mb")] = vm.Flavor.RAM
+			fields[n.Field("disk_gb")] = vm.Flavor.Disk
+		}
+	}
+	for k, v := range s.Tags {
+		tags[n.Tag(k)] = v
+	}
+	for k, v := range s.Fields {
+		fields[n.Field(k)] = v
+	}
+	return tags, fields
+}
@@ -0,0 +1,90 @@
+package sink
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+	metrics "github.com/cheetahfox/openstack-instance-stats/metrics"
+)
+
+func TestNaming(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        config.Naming
+		measurement string
+		tag         string
+		field       string
+		want        [3]string
+	}{
+		{"legacy", config.Naming{Profile: "legacy"}, "OpenStack disk", "Instance Name", "memory-actual", [3]string{"OpenStack disk", "Instance Name", "memory-actual"}},
+		{"v2", config.Naming{Profile: "v2"}, "OpenStack disk", "Instance Name", "memory-actual", [3]string{"openstack_disk", "instance_name", "memory_actual"}},
+		{"v2 renamed field", config.Naming{Profile: "v2"}, "OpenStack Metrics", "UUID", "cpu_total", [3]string{"openstack_instance", "uuid", "cpu_time_total"}},
+		{"v2 inventory", config.Naming{Profile: "v2"}, "OpenStack events", "Previous Status", "status_change", [3]string{"openstack_events", "previous_status", "status_change"}},
+		{"not in the profile", config.Naming{Profile: "v2"}, "something else", "hypervisor_hostname", "vda_read", [3]string{"something else", "hypervisor_hostname", "vda_read"}},
+		{"overrides", config.Naming{
+			Profile:      "v2",
+			Measurements: map[string]string{"OpenStack disk": "disk"},
+			Tags:         map[string]string{"UUID": "instance_id"},
+			Fields:       map[string]string{"cpu_total": "cpu_ns"},
+		}, "OpenStack disk", "UUID", "cpu_total", [3]string{"disk", "instance_id", "cpu_ns"}},
+		{"overrides on legacy", config.Naming{Profile: "legacy", Fields: map[string]string{"memory-actual": "balloon"}}, "OpenStack memory", "MAC", "memory-actual", [3]string{"OpenStack memory", "MAC", "balloon"}},
+	}
+	for _, tt := range tests {
+		n, err := NewNaming(tt.conf)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		got := [3]string{n.Measurement(tt.measurement), n.Tag(tt.tag), n.Field(tt.field)}
+		if got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := NewNaming(config.Naming{Profile: "v3"}); err == nil {
+		t.Error("an unknown profile was taken")
+	}
+	var legacy *Naming
+	if legacy.Measurement("OpenStack disk") != "OpenStack disk" || legacy.Tag("UUID") != "UUID" || legacy.Field("memory-actual") != "memory-actual" {
+		t.Error("a nil Naming changed the names")
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	vm := &metrics.Vms{
+		UUID:        "uuid",
+		Name:        "web-1",
+		ProjectID:   "p1",
+		ProjectName: "web",
+		Cloud:       "prod",
+		Hypervisor:  "compute-1",
+		IP:          net.ParseIP("10.0.0.5"),
+		Tags:        map[string]string{"team": "frontend", "UUID": "spoofed"},
+		Flavor:      metrics.Flavor{Name: "m1.small", VCPUs: 2, RAM: 2048, Disk: 20},
+	}
+	tests := []struct {
+		name   string
+		sample Sample
+		tags   map[string]string
+		fields map[string]interface{}
+	}{
+		{"instance", Sample{Measurement: "OpenStack disk", Instance: vm, Tags: map[string]string{"Device": "vda"}, Fields: map[string]float64{"read_ops": 1}, Time: time.Now()},
+			map[string]string{"team": "frontend", "Instance Name": "web-1", "UUID": "uuid", "Project": "p1", "Project Name": "web", "cloud": "prod",
+				"hypervisor_hostname": "compute-1", "Flavor": "m1.small", "IP": "10.0.0.5", "Device": "vda"},
+			map[string]interface{}{"read_ops": 1.0, "vcpus": 2, "ram_mb": 2048, "disk_gb": 20}},
+		{"not an instance", Sample{Measurement: "OpenStack hypervisor", Tags: map[string]string{"hypervisor_hostname": "compute-1"}, Fields: map[string]float64{"vcpus_used": 4}},
+			map[string]string{"hypervisor_hostname": "compute-1"},
+			map[string]interface{}{"vcpus_used": 4.0}},
+	}
+	for _, tt := range tests {
+		tags, fields := (*Naming)(nil).Flatten(tt.sample)
+		if !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("%s: tags %v, want %v", tt.name, tags, tt.tags)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: fields %v, want %v", tt.name, fields, tt.fields)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package sink
+
+import (
+	"context"
+	"time"
+
+	metrics "github.com/cheetahfox/openstack-instance-stats/metrics"
+)
+
+/*
+Sample is one point in a backend neutral form, every output gets the same
+samples and turns them into whatever it writes.
+*/
+type Sample struct {
+	Measurement string
+	Instance    *metrics.Vms      // the instance the sample is about, nil for anything else
+	Tags        map[string]string // tags of this sample on top of the instance ones
+	Fields      map[string]float64
+	Time        time.Time
+}
+
+// Sink is an output the samples of each collection pass are written to.
+type Sink interface {
+	Name() string
+	// Write hands over a batch of samples, the sink owns them after this
+	Write(samples []Sample) error
+	// Close flushes anything still buffered
+	Close() error
+}
+
+// Checker is implemented by sinks that can tell whether their backend is up.
+type Checker interface {
+	Health(ctx context.Context) error
+}
+
+// Stats is implemented by sinks that keep counters about themselves, like points written or dropped.
+type Stats interface {
+	Stats() map[string]float64
+}
+
+/*
+Batch gathers the samples for an instance or a pass so they can be handed to
+the sinks in one go. Every sample in a batch gets the same timestamp.
+*/
+type Batch struct {
+	Time    time.Time
+	Samples []Sample
+}
+
+func NewBatch(t time.Time) *Batch {
+	return &Batch{Time: t}
+}
+
+// Point adds a single field for an instance
+func (b *Batch) Point(s metrics.Vms, m string, f string, v float64) {
+	b.TaggedPoint(s, m, nil, f, v)
+}
+
+// TaggedPoint is Point with extra tags, like the device a disk or network stat is for
+func (b *Batch) TaggedPoint(s metrics.Vms, m string, tags map[string]string, f string, v float64) {
+	b.Samples = append(b.Samples, Sample{
+		Measurement: m,
+		Instance:    &s,
+		Tags:        tags,
+		Fields:      map[string]float64{f: v},
+		Time:        b.Time,
+	})
+}
+
+// InstanceFields is TaggedPoint with more than one field
+func (b *Batch) InstanceFields(s metrics.Vms, m string, tags map[string]string, fields map[string]float64) {
+	b.Samples = append(b.Samples, Sample{
+		Measurement: m,
+		Instance:    &s,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        b.Time,
+	})
+}
+
+// Fields adds a single sample that isn't about an instance, like a hypervisor
+func (b *Batch) Fields(m string, tags map[string]string, fields map[string]float64) {
+	b.Samples = append(b.Samples, Sample{
+		Measurement: m,
+		Tags:        tags,
+		Fields:      fields,
+		Time:        b.Time,
+	})
+}
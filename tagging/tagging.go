@@ -0,0 +1,178 @@
+package tagging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+)
+
+// What values past the max_values of a tag are written as
+const Other = "_other"
+
+/*
+Tagger picks the allowlisted metadata and server tags off a server and turns
+them into point tags. Every tag only gets max_values distinct values, so a
+metadata key that turns out to hold something like a build id can't blow up
+the number of series. It's shared by all the targets.
+
+Values no longer count towards max_values once no instance in any inventory
+has had them for two inventory intervals.
+*/
+type Tagger struct {
+	metadata   map[string]string // metadata key to tag name
+	serverTags map[string]string // server tag to tag name
+	maxValues  int
+	staleAfter time.Duration
+
+	mu     sync.Mutex
+	values map[string]map[string]time.Time // tag name, value, last seen
+	capped map[string]bool                 // tags we've logged hitting max_values
+}
+
+func New(conf config.Tags, inventoryInterval time.Duration) (*Tagger, error) {
+	t := &Tagger{
+		metadata:   make(map[string]string, len(conf.Metadata)),
+		serverTags: make(map[string]string, len(conf.ServerTags)),
+		maxValues:  conf.MaxValues,
+		staleAfter: 2 * inventoryInterval,
+		values:     make(map[string]map[string]time.Time),
+		capped:     make(map[string]bool),
+	}
+
+	// Two keys that sanitize to the same name would overwrite each other
+	names := make(map[string]string)
+	add := func(kind, key string, to map[string]string) error {
+		name := Sanitize(key)
+		if name == "" {
+			return fmt.Errorf("instance_tags: %s %q has no usable characters", kind, key)
+		}
+		if other, found := names[name]; found {
+			return fmt.Errorf("instance_tags: %s %q and %s are both tagged as %s", kind, key, other, name)
+		}
+		names[name] = fmt.Sprintf("%s %q", kind, key)
+		to[key] = name
+		return nil
+	}
+	for _, key := range conf.Metadata {
+		if err := add("metadata", key, t.metadata); err != nil {
+			return nil, err
+		}
+	}
+	for _, tag := range conf.ServerTags {
+		if err := add("server tag", tag, t.serverTags); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+/*
+Sanitize makes a tag name that works everywhere, Prometheus labels being the
+strictest: lower case letters, digits and underscores, not starting with a
+digit. "Cost Center" becomes cost_center and "app.kubernetes.io/name"
+app_kubernetes_io_name.
+*/
+func Sanitize(name string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			underscore = false
+			continue
+		}
+		// Runs of anything else become a single _
+		if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	s := strings.TrimSuffix(b.String(), "_")
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// Tags for a server, nil when there's nothing to tag it with
+func (t *Tagger) Tags(metadata map[string]string, serverTags []string) map[string]string {
+	if len(t.metadata) == 0 && len(t.serverTags) == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var tags map[string]string
+	set := func(name, value string) {
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[name] = t.limit(name, value, now)
+	}
+	for key, name := range t.metadata {
+		// An empty tag value isn't allowed in line protocol
+		if value := metadata[key]; value != "" {
+			set(name, value)
+		}
+	}
+	for _, tag := range serverTags {
+		if name, found := t.serverTags[tag]; found {
+			set(name, "true")
+		}
+	}
+	return tags
+}
+
+/*
+Seen marks the tag values of a server still in the inventory as in use. Only
+changed servers go through Tags between full listings, so without it the values
+of the rest would go stale and make room for new ones.
+*/
+func (t *Tagger) Seen(tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for name, value := range tags {
+		if _, found := t.values[name][value]; found {
+			t.values[name][value] = now
+		}
+	}
+}
+
+// The value to write for a tag, Other once it has max_values others. Needs to be called holding mu.
+func (t *Tagger) limit(name, value string, now time.Time) string {
+	values, found := t.values[name]
+	if !found {
+		values = make(map[string]time.Time)
+		t.values[name] = values
+	}
+	if _, found := values[value]; found || len(values) < t.maxValues {
+		values[value] = now
+		return value
+	}
+
+	// Make room with the values of instances that have gone away
+	for v, seen := range values {
+		if now.Sub(seen) > t.staleAfter {
+			delete(values, v)
+		}
+	}
+	if len(values) < t.maxValues {
+		values[value] = now
+		return value
+	}
+	if !t.capped[name] {
+		log.Printf("Tag %s has more than %d values, the rest are written as %s\n", name, t.maxValues, Other)
+		t.capped[name] = true
+	}
+	return Other
+}
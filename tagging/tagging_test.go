@@ -0,0 +1,93 @@
+package tagging
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	config "github.com/cheetahfox/openstack-instance-stats/config"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"team", "team"},
+		{"Cost Center", "cost_center"},
+		{"app.kubernetes.io/name", "app_kubernetes_io_name"},
+		{"--env--", "env"},
+		{"2fa", "_2fa"},
+		{"ÄÖ", ""},
+	}
+	for _, tt := range tests {
+		if got := Sanitize(tt.name); got != tt.want {
+			t.Errorf("Sanitize(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.Tags
+		err  bool
+	}{
+		{"metadata and tags", config.Tags{Metadata: []string{"team"}, ServerTags: []string{"prod"}, MaxValues: 1}, false},
+		{"nothing usable", config.Tags{Metadata: []string{"!!"}, MaxValues: 1}, true},
+		{"same name", config.Tags{Metadata: []string{"Cost Center"}, ServerTags: []string{"cost-center"}, MaxValues: 1}, true},
+	}
+	for _, tt := range tests {
+		_, err := New(tt.conf, time.Minute)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	tagger, err := New(config.Tags{Metadata: []string{"Team"}, ServerTags: []string{"prod"}, MaxValues: 2}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		metadata   map[string]string
+		serverTags []string
+		want       map[string]string
+	}{
+		{"nothing allowlisted", map[string]string{"other": "x"}, []string{"dev"}, nil},
+		{"empty value", map[string]string{"Team": ""}, nil, nil},
+		{"metadata and tag", map[string]string{"Team": "web"}, []string{"prod", "dev"}, map[string]string{"team": "web", "prod": "true"}},
+		{"second value", map[string]string{"Team": "db"}, nil, map[string]string{"team": "db"}},
+		{"past max_values", map[string]string{"Team": "ci-1234"}, nil, map[string]string{"team": Other}},
+		{"known value", map[string]string{"Team": "web"}, nil, map[string]string{"team": "web"}},
+	}
+	for _, tt := range tests {
+		if got := tagger.Tags(tt.metadata, tt.serverTags); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Values of servers still in the inventory keep their place, the rest make room
+func TestStaleValues(t *testing.T) {
+	interval := 20 * time.Millisecond
+	tagger, err := New(config.Tags{Metadata: []string{"team"}, MaxValues: 2}, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := tagger.Tags(map[string]string{"team": "web"}, nil)
+	tagger.Tags(map[string]string{"team": "gone"}, nil)
+
+	// An inventory pass or so after the last change to either server
+	for deadline := time.Now().Add(3 * interval); time.Now().Before(deadline); time.Sleep(interval / 4) {
+		tagger.Seen(live)
+	}
+	if got := tagger.Tags(map[string]string{"team": "new"}, nil); got["team"] != "new" {
+		t.Errorf("the stale value didn't make room, got %s", got["team"])
+	}
+	if got := tagger.Tags(map[string]string{"team": "another"}, nil); got["team"] != Other {
+		t.Errorf("the live value was dropped for %s", got["team"])
+	}
+}